@@ -0,0 +1,155 @@
+package membertable
+
+import (
+    "errors"
+    "log"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+var (
+    ErrNoSuchMember = errors.New("no member with that address")
+    ErrAmbiguousMember = errors.New("more than one member has that address")
+    ErrEvictSelf = errors.New("a member cannot evict itself")
+)
+
+// What an operator sees about a member
+type MemberInfo struct {
+    Member Member
+    // how long since we last heard a new heartbeat from it
+    Age time.Duration
+    // alive, failed or evicted
+    Status string
+}
+
+type Stats struct {
+    Me ID
+    Incarnation int64
+    HeartbeatID int64
+    Alive int
+    Failed int
+    Evicted int
+    HeartbeatsSent int64
+    SendErrors int64
+    HeartbeatsReceived int64
+    Refutations int64
+    Evictions int64
+}
+
+func (m Member) Status() string {
+    if m.Evicted {
+        return "evicted"
+    }
+    if m.IsFailed {
+        return "failed"
+    }
+    return "alive"
+}
+
+// Every member we know of, failed and evicted ones included, by address
+func (t *Table) MemberInfos() []MemberInfo {
+    t.lock()
+    defer t.unlock()
+    now := t.now()
+    infos := make([]MemberInfo, 0, len(t.Members))
+    for _, mem := range t.Members {
+        infos = append(infos, MemberInfo{mem, time.Duration(now - mem.lastHeard), mem.Status()})
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        a, b := infos[i].Member.ID, infos[j].Member.ID
+        if a.Address != b.Address {
+            return a.Address < b.Address
+        }
+        return a.Name < b.Name
+    })
+    return infos
+}
+
+func (t *Table) GetStats() Stats {
+    t.lock()
+    defer t.unlock()
+    me := t.Members[t.myID]
+    m := t.metrics
+    s := Stats{
+        Me: t.myID,
+        Incarnation: me.Incarnation,
+        HeartbeatID: me.HeartbeatID,
+        HeartbeatsReceived: atomic.LoadInt64(&m.received),
+        Refutations: atomic.LoadInt64(&m.refutations),
+        Evictions: atomic.LoadInt64(&m.evictions),
+    }
+    for kind := range m.sent {
+        s.HeartbeatsSent += atomic.LoadInt64(&m.sent[kind])
+        s.SendErrors += atomic.LoadInt64(&m.sendErrors[kind])
+    }
+    for _, mem := range t.Members {
+        switch {
+            case mem.Evicted: s.Evicted++
+            case mem.IsFailed: s.Failed++
+            default: s.Alive++
+        }
+    }
+    return s
+}
+
+// Mark the given incarnation of a member evicted. The entry is gossiped until
+// it gets dropped, and the member itself stops when it hears about it. The
+// member is gone for good, so the cluster is expected to be one smaller.
+func (t *Table) evict(id ID, incarnation int64) {
+    mem, exists := t.Members[id]
+    if exists && !mem.Evicted && t.largestSize > 1 {
+        t.largestSize--
+    }
+    mem.ID = id
+    mem.Incarnation = incarnation
+    mem.IsFailed = true
+    mem.Evicted = true
+    mem.lastHeard = t.now()
+    t.Members[id] = mem
+    t.queueUpdate(id)
+    atomic.AddInt64(&t.metrics.evictions, 1)
+    t.checkPartition()
+}
+
+// Evict the member at the given address and tell it about it. ID numbers
+// are not unique, so the address picks the member.
+func (t *Table) Evict(addr string) error {
+    t.lock()
+    defer t.unlock()
+    var found []ID
+    for id := range t.Members {
+        if id.Address == addr {
+            found = append(found, id)
+        }
+    }
+    if len(found) == 0 {
+        return ErrNoSuchMember
+    }
+    if len(found) > 1 {
+        return ErrAmbiguousMember
+    }
+    id := found[0]
+    if id == t.myID {
+        return ErrEvictSelf
+    }
+    log.Println("evicting member", id)
+    t.evict(id, t.Members[id].Incarnation)
+    t.post(kindSync, id.Address, []Member{t.Members[id]})
+    t.onChange(found, true)
+    return nil
+}
+
+func (t *Table) RPCGetMembers(dummy int, infos *[]MemberInfo) error {
+    *infos = t.MemberInfos()
+    return nil
+}
+
+func (t *Table) RPCGetStats(dummy int, stats *Stats) error {
+    *stats = t.GetStats()
+    return nil
+}
+
+func (t *Table) RPCEvict(addr string, dummy *int) error {
+    return t.Evict(addr)
+}
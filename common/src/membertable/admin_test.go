@@ -0,0 +1,140 @@
+package membertable
+
+import (
+    "strconv"
+    "testing"
+)
+
+func newTable(num IDNum) *Table {
+    var t Table
+    t.Init(ID{Num: num, Address: "host" + strconv.Itoa(int(num))})
+    return &t
+}
+
+func TestEvictionIsGossipedAndFinal(t *testing.T) {
+    a, b, c := newTable(1), newTable(2), newTable(3)
+    a.MergeTables(b.gossipMembers())
+    a.MergeTables(c.gossipMembers())
+    c.MergeTables(a.gossipMembers())
+    zombie := b.Members[b.myID]
+
+    if err := a.Evict("host2"); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.Evict("host1"); err != ErrEvictSelf {
+        t.Error("evicting ourselves returned", err)
+    }
+    if err := a.Evict("host9"); err != ErrNoSuchMember {
+        t.Error("evicting a stranger returned", err)
+    }
+
+    // The eviction spreads with normal gossip
+    c.MergeTables(a.gossipMembers())
+    if c.Members[zombie.ID].Status() != "evicted" {
+        t.Fatal("c did not learn of the eviction")
+    }
+
+    // The zombie's own heartbeats can't bring it back
+    zombie.HeartbeatID += 10
+    c.MergeMember(zombie)
+    if !c.IsDead(zombie.ID) {
+        t.Error("an evicted member came back by heartbeating")
+    }
+
+    // and it can't refute the eviction either
+    b.MergeTables(c.gossipMembers())
+    if !b.evicted || b.Members[b.myID].Incarnation != zombie.Incarnation {
+        t.Error("the evicted member refuted its eviction")
+    }
+
+    // A real restart is a new incarnation and may join again
+    zombie.Incarnation++
+    c.MergeMember(zombie)
+    if c.IsDead(zombie.ID) {
+        t.Error("a restarted member could not rejoin after an eviction")
+    }
+}
+
+// New members all have ID number 0, so only the address tells them apart
+func TestEvictByAddress(t *testing.T) {
+    tables := make([]*Table, 3)
+    for i := range tables {
+        tables[i] = new(Table)
+        tables[i].Init(ID{Address: "host" + strconv.Itoa(i)})
+    }
+    a := tables[0]
+    for _, other := range tables[1:] {
+        a.MergeTables(other.gossipMembers())
+    }
+
+    if err := a.Evict("host1"); err != nil {
+        t.Fatal(err)
+    }
+    for _, table := range tables {
+        id := table.myID
+        if evicted := a.Members[id].Evicted; evicted != (id.Address == "host1") {
+            t.Error(id, "evicted:", evicted)
+        }
+    }
+
+    // A member that restarted under another name is listed twice until the
+    // old entry is dropped, and an address naming two members is refused
+    a.MergeMember(Member{ID: ID{Name: "renamed", Address: "host2"}})
+    if err := a.Evict("host2"); err != ErrAmbiguousMember {
+        t.Error("evicting a shared address returned", err)
+    }
+}
+
+type fixedClock struct {
+    now Timestamp
+}
+
+func (c *fixedClock) Now() Timestamp {
+    return c.now
+}
+
+func TestExpectedSizeShrinks(t *testing.T) {
+    clock := &fixedClock{}
+    tables := make([]*Table, 5)
+    for i := range tables {
+        tables[i] = newTable(IDNum(i + 1))
+        tables[i].Clock = clock
+        tables[i].Transport = discardTransport{}
+    }
+    a, b := tables[0], tables[1]
+    for _, other := range tables[1:] {
+        a.MergeTables(other.gossipMembers())
+    }
+    b.MergeTables(a.gossipMembers())
+    if size := a.Partition().Expected; size != 5 {
+        t.Fatal("expected size is", size)
+    }
+
+    // Evicted members are not waited for, whether we evicted them or heard
+    // about it
+    for num := IDNum(3); num <= 5; num++ {
+        if err := a.Evict("host" + strconv.Itoa(int(num))); err != nil {
+            t.Fatal(err)
+        }
+    }
+    b.MergeTables(a.gossipMembers())
+    for _, table := range []*Table{a, b} {
+        if status := table.Partition(); status.Expected != 2 || status.Minority {
+            t.Errorf("after evictions %v has %+v", table.myID, status)
+        }
+    }
+
+    // Members that just stop are still expected until an operator resizes
+    c := newTable(6)
+    c.Clock = clock
+    c.MergeTables(a.gossipMembers())
+    c.MergeTables(b.gossipMembers())
+    clock.now += TFail + 1
+    if !c.InMinority() {
+        t.Fatal("alone out of 3 is not in the minority")
+    }
+    c.ResetExpectedSize()
+    if status := c.Partition(); status.Expected != 1 || status.Minority {
+        t.Error("after a resize", status)
+    }
+}
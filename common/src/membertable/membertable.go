@@ -0,0 +1,848 @@
+package membertable
+
+import (
+    "bytes"
+    "os"
+    "io"
+    "io/ioutil"
+    "log"
+    "time"
+    "net"
+    "math/rand"
+    "encoding/gob"
+    "encoding/binary"
+    "hash/fnv"
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+const HeartbeatInterval = 40 * time.Millisecond
+const TFail = Timestamp(2 * time.Second)
+const TDrop = Timestamp(3 * TFail)
+
+// Each changed entry is piggybacked on RetransmitMult * log2(N) heartbeats
+// before it is dropped from the update queue
+const RetransmitMult = 3
+
+// The most changed entries piggybacked on a single heartbeat
+const MaxPiggyback = 32
+
+// Every FullSyncInterval heartbeats we send the whole table instead of a delta
+// so that anything the piggybacking missed is eventually repaired
+const FullSyncInterval = 25
+
+type IDNum int32
+
+type ID struct{
+    Num IDNum
+    Name string
+    Address string
+}
+
+func (id *ID) GetColor() string {
+    num := uint(id.Num) + dHash(id.Address) + dHash(id.Name)
+    switch num % 6 {
+        case 0: return "1;31";
+        case 1: return "1;32";
+        case 2: return "1;34";
+        case 3: return "1;33";
+        case 4: return "1;35";
+        case 5: return "1;36";
+    }
+    return "0";
+}
+
+func (id *ID) Hashed() uint32 {
+    hasher := fnv.New32a()
+    binary.Write(hasher, binary.BigEndian, id.Num)
+    binary.Write(hasher, binary.BigEndian, []byte(id.Name))
+    binary.Write(hasher, binary.BigEndian, []byte(id.Address))
+    return hasher.Sum32()
+}
+
+// djb2 hashing algorithm
+func dHash(s string) uint {
+    hash := uint(5381)
+    var c uint
+    i := uint(0)
+    for i < uint(len(s)) {
+        hash = ((hash << 5) + hash) + c
+        i++
+    }
+    return hash
+}
+
+// Nanoseconds since this process started, read from the monotonic clock.
+// Timestamps only mean something on the machine that took them, so they are
+// never sent to other members.
+type Timestamp int64
+
+var processStart = time.Now()
+
+type Member struct {
+    ID ID
+    // bumped every time the member restarts or refutes being marked failed;
+    // an entry with a higher incarnation always wins
+    Incarnation int64
+    HeartbeatID int64
+    // when we last heard a new heartbeat from the member, by our own clock.
+    // Unexported so it stays off the wire.
+    lastHeard Timestamp
+    IsFailed bool
+    // set by an operator; an evicted incarnation can never come back, not even
+    // by refuting
+    Evicted bool
+    Meta Meta
+}
+
+type Table struct {
+    Members map[ID]Member
+    // callback. Gives the current table and the list of processes added or
+    // removed (by ID)
+    Changed func(t *Table, processChanged []ID, dropped bool)
+    myID ID
+
+    // All of these default to the real network, clock and random source
+    Transport Transport
+    Clock Clock
+    Rand *rand.Rand
+
+    // remaining number of times each changed member will be piggybacked, and
+    // the heartbeat it was last piggybacked on
+    updates map[ID]int
+    lastSent map[ID]int
+    heartbeats int
+
+    // failed members we still have to tell that we think they failed
+    suspects []ID
+    // set once we learn we were evicted; we stop heartbeating for good
+    evicted bool
+
+    // Addresses (host:port, possibly resolving to several machines) or DNS
+    // SRV names to join through, tried in order
+    Seeds []string
+    // the heartbeat on which we next go back to the seeds while alone, and
+    // how long we waited last time
+    nextReseed int
+    reseedWait int
+
+    // Where the table is saved every SnapshotInterval heartbeats; empty to
+    // never save it
+    SnapshotFile string
+    // members loaded from a snapshot that have not answered yet, and when we
+    // give up on them
+    suspected map[ID]Member
+    suspectedUntil Timestamp
+    probeNext int
+
+    // set once ListenUDP succeeds; heartbeats go over UDP from then on
+    udpConn *net.UDPConn
+
+    metrics *metrics
+
+    // The number of members the cluster should have. If zero, the largest
+    // number seen alive at once is used instead.
+    ExpectedSize int
+    largestSize int
+    minority bool
+
+    // Held by every exported method; heartbeats, RPCs and UDP packets all
+    // arrive on their own goroutines
+    mutex sync.Mutex
+    // Messages to send and changes to report once the lock is released.
+    // Sending under it could deadlock two members heartbeating each other
+    // over RPC, and Changed usually reads the table.
+    outbox []message
+    changes []change
+}
+
+// A message queued while the lock is held; kind is one of the metrics kinds
+type message struct {
+    kind int
+    addr string
+    members []Member
+}
+
+type change struct {
+    ids []ID
+    dropped bool
+}
+
+func (t *Table) lock() {
+    t.mutex.Lock()
+}
+
+// Release the lock, then send the queued messages and report the queued
+// changes. Returns the error from the last message sent.
+func (t *Table) unlock() error {
+    outbox, changes, transport, changed := t.outbox, t.changes, t.transport(), t.Changed
+    t.outbox, t.changes = nil, nil
+    t.mutex.Unlock()
+
+    var err error
+    for _, m := range outbox {
+        err = t.send(transport, m)
+    }
+    if changed != nil {
+        for _, c := range changes {
+            changed(t, c.ids, c.dropped)
+        }
+    }
+    return err
+}
+
+// Queue a message to be sent when the lock is released
+func (t *Table) post(kind int, addr string, members []Member) {
+    t.outbox = append(t.outbox, message{kind, addr, members})
+}
+
+func (t *Table) send(transport Transport, m message) error {
+    var err error
+    switch m.kind {
+        case kindSync: err = transport.Sync(m.addr, m.members)
+        case kindPing: err = transport.Ping(m.addr, m.members[0])
+        default: err = transport.Heartbeat(m.addr, m.members)
+    }
+    t.countSent(m.kind, len(m.members), err)
+    return err
+}
+
+// initialize the Table struct with only myself as a member
+// timestamp is time of init
+// HeartbeatID is set to 0
+// IsFailed is false
+func (t *Table) Init(me ID) {
+    t.InitIncarnation(me, 0)
+}
+
+// Same as Init, but for a member that has run before under the same ID
+func (t *Table) InitIncarnation(me ID, incarnation int64) {
+    t.lock()
+    defer t.unlock()
+    t.Members = make(map[ID]Member)
+    t.updates = make(map[ID]int)
+    t.lastSent = make(map[ID]int)
+    t.metrics = newMetrics()
+    t.myID = me
+
+    member := Member{
+        ID: me,
+        Incarnation: incarnation,
+        HeartbeatID: 0,
+        lastHeard: t.now(),
+        IsFailed: false,
+    }
+    t.Members[me] = member
+}
+
+func (t *Table) MyID() ID {
+    t.lock()
+    defer t.unlock()
+    return t.myID
+}
+
+func (t *Table) GetTime(id ID) Timestamp {
+    t.lock()
+    defer t.unlock()
+    return t.Members[id].lastHeard
+}
+
+func (t *Table) IsDead(id ID) bool {
+    t.lock()
+    defer t.unlock()
+    mem, exists := t.Members[id]
+
+    return !exists || mem.IsFailed
+}
+
+// Report a change to Changed once the lock is released
+func (t *Table) onChange(processesChanged []ID, dropped bool) {
+    t.changes = append(t.changes, change{processesChanged, dropped})
+}
+
+// returns a timestamp for the current time when called. It never jumps when
+// the wall clock is set, so it is safe to take differences of.
+func StampNow() Timestamp {
+    return Timestamp(time.Since(processStart))
+}
+
+func (t *Table) JoinMember(m *Member) {
+    t.lock()
+    defer t.unlock()
+    t.joinMember(m)
+}
+
+func (t *Table) joinMember(m *Member) {
+    // set m.LastHeartbeat to now
+    // add m to t.Members
+    log.Println("Adding member: Id=", m.ID.Num, ", name=", m.ID.Name)
+    m.lastHeard = t.now()
+    m.IsFailed = false
+    t.Members[m.ID] = *m
+    delete(t.suspected, m.ID)
+}
+
+func (t *Table) HeartbeatMember(id ID) {
+    t.lock()
+    defer t.unlock()
+    t.heartbeatMember(id)
+}
+
+func (t *Table) heartbeatMember(id ID) {
+    // update the timestamp of the member of the given id
+    mem, exists := t.Members[id]
+
+    if !exists {
+        log.Println("Tried to update timestamp of a nonmember")
+    }
+
+    if mem.IsFailed {
+        log.Println("Tried to update timestamp of a failed member")
+    }
+    mem.lastHeard = t.now()
+    t.Members[id] = mem
+}
+
+func (t *Table) dropMember(id ID) {
+    delete(t.Members, id)
+    delete(t.updates, id)
+    delete(t.lastSent, id)
+}
+
+func (t *Table) RemoveDead() {
+    t.lock()
+    defer t.unlock()
+    t.removeDead()
+}
+
+func (t *Table) removeDead() {
+    // remove dead members
+    failedProcess := false
+    failedProcesses := make([]ID, 0, 5)
+    alive, failed := int64(1), int64(0)
+    for id, mem := range t.Members {
+        if mem.ID == t.myID {
+            continue
+        }
+        curTime := t.now()
+        time := mem.lastHeard
+        if !mem.IsFailed && curTime - time > TFail {
+            // process not heard from, mark as failed
+            log.Println("member", id, "has failed")
+            mem.IsFailed = true
+            t.Members[id] = mem
+            t.suspects = append(t.suspects, id)
+            failedProcess = true
+            failedProcesses = append(failedProcesses, mem.ID)
+            atomic.AddInt64(&t.metrics.failures, 1)
+            t.metrics.detectionLatency.observe(seconds(curTime - time))
+        }
+        if curTime - time > TDrop {
+            t.dropMember(id)
+        } else if mem.IsFailed {
+            failed++
+        } else {
+            alive++
+        }
+    }
+    atomic.StoreInt64(&t.metrics.alive, alive)
+    atomic.StoreInt64(&t.metrics.failed, failed)
+    t.checkPartition()
+    if failedProcess {
+        sort.Slice(failedProcesses, func(i, j int) bool {
+            return idLess(failedProcesses[i], failedProcesses[j])
+        })
+        t.onChange(failedProcesses, true)
+    }
+}
+
+// The members we sync: everyone alive, plus evictions that still have to
+// reach the rest of the cluster
+func (t *Table) gossipMembers() []Member {
+    members := t.activeMembers()
+    for _, mem := range t.Members {
+        if mem.Evicted {
+            members = append(members, mem)
+        }
+    }
+    sort.Slice(members, func(i, j int) bool {
+        return idLess(members[i].ID, members[j].ID)
+    })
+    return members
+}
+
+func (t *Table) ActiveMembers() []Member {
+    t.lock()
+    defer t.unlock()
+    return t.activeMembers()
+}
+
+func (t *Table) activeMembers() []Member {
+    t.removeDead()
+    memberArray := make([]Member, len(t.Members))
+    index := 0
+    for _, member := range t.Members {
+        if !member.IsFailed {
+            memberArray[index] = member
+            index += 1
+        }
+    }
+    memberArray = memberArray[0:index]
+
+    // Keep a stable order so a seeded Rand makes the same choices every run
+    sort.Slice(memberArray, func(i, j int) bool {
+        return idLess(memberArray[i].ID, memberArray[j].ID)
+    })
+    return memberArray
+}
+
+func idLess(a, b ID) bool {
+    if a.Num != b.Num {
+        return a.Num < b.Num
+    }
+    if a.Address != b.Address {
+        return a.Address < b.Address
+    }
+    return a.Name < b.Name
+}
+
+func (t *Table) WriteTo(w io.Writer) error {
+    // remove the dead
+    // Write out t.Members as an array using gob. Might require converting the map to an array
+    t.lock()
+    data := t.activeMembers()
+    t.unlock()
+    enc := gob.NewEncoder(w)
+    return enc.Encode(data)
+}
+
+func (t *Table) MergeMember(member Member) {
+    t.lock()
+    defer t.unlock()
+    t.mergeMember(member)
+}
+
+func (t *Table) mergeMember(member Member) {
+    if member.ID == t.myID {
+        t.refute(member)
+        return
+    }
+
+    myInfo, exists := t.Members[member.ID]
+    if member.Evicted {
+        if !myInfo.Evicted && (!exists || member.Incarnation >= myInfo.Incarnation) {
+            log.Println("member", member.ID, "was evicted")
+            t.evict(member.ID, member.Incarnation)
+            if exists && !myInfo.IsFailed {
+                t.onChange([]ID{member.ID}, true)
+            }
+        }
+        return
+    }
+    if member.IsFailed {
+        // Everyone decides who failed for themselves
+        return
+    }
+    if exists && member.Incarnation > myInfo.Incarnation {
+        // The member restarted or refuted a failure, which overrides whatever
+        // we thought about its old incarnation
+        wasFailed := myInfo.IsFailed
+        myInfo.Incarnation = member.Incarnation
+        myInfo.HeartbeatID = member.HeartbeatID
+        myInfo.IsFailed = false
+        myInfo.Evicted = false
+        myInfo.Meta = member.Meta
+        t.Members[member.ID] = myInfo
+        t.heartbeatMember(member.ID)
+        delete(t.updates, member.ID)
+        t.queueUpdate(member.ID)
+        if wasFailed {
+            log.Println("member", member.ID, "is back with incarnation", member.Incarnation)
+            atomic.AddInt64(&t.metrics.falsePositives, 1)
+            t.checkPartition()
+            t.onChange([]ID{member.ID}, false)
+        }
+    } else if exists {
+        failed := myInfo.IsFailed
+        if myInfo.Incarnation == member.Incarnation && member.Meta.Version > myInfo.Meta.Version && !failed {
+            log.Println("member", member.ID, "has new metadata", member.Meta.Tags)
+            myInfo.Meta = member.Meta
+            t.Members[member.ID] = myInfo
+            t.queueUpdate(member.ID)
+            t.onChange([]ID{member.ID}, false)
+        }
+        if myInfo.Incarnation == member.Incarnation && myInfo.HeartbeatID < member.HeartbeatID  && !failed {
+            t.metrics.heartbeatGap.observe(seconds(t.now() - myInfo.lastHeard))
+            myInfo.HeartbeatID = member.HeartbeatID
+            t.Members[member.ID] = myInfo
+            t.heartbeatMember(member.ID)
+            t.queueUpdate(member.ID)
+        }
+    } else {
+        t.joinMember(&member)
+        t.queueUpdate(member.ID)
+        t.checkPartition()
+        t.onChange([]ID{member.ID}, false)
+    }
+}
+
+// Someone sent us an entry about ourselves. If they think we failed, start a
+// new incarnation so our heartbeats override their failed entry.
+func (t *Table) refute(member Member) {
+    me := t.Members[t.myID]
+    if member.Evicted && member.Incarnation >= me.Incarnation {
+        if !t.evicted {
+            log.Println("we were evicted from the cluster; no longer heartbeating")
+            t.evicted = true
+        }
+        return
+    }
+    if member.IsFailed && member.Incarnation >= me.Incarnation {
+        me.Incarnation = member.Incarnation + 1
+        me.HeartbeatID = 0
+        t.Members[t.myID] = me
+        atomic.AddInt64(&t.metrics.refutations, 1)
+        log.Println("refuting failure, now incarnation", me.Incarnation)
+    }
+}
+
+// Tell members we marked failed that we did. If they are alive after all they
+// will refute it. Our own entry goes along so they can revive us as well.
+func (t *Table) notifySuspects() {
+    // Every so often retell everyone still marked failed in case the first
+    // notice got lost
+    if t.heartbeats % FullSyncInterval == 0 {
+        t.suspects = t.suspects[:0]
+        for id, mem := range t.Members {
+            if mem.IsFailed {
+                t.suspects = append(t.suspects, id)
+            }
+        }
+        sort.Slice(t.suspects, func(i, j int) bool {
+            return idLess(t.suspects[i], t.suspects[j])
+        })
+    }
+
+    for _, id := range t.suspects {
+        mem, exists := t.Members[id]
+        if exists && mem.IsFailed {
+            t.post(kindSuspect, id.Address, []Member{mem, t.Members[t.myID]})
+        }
+    }
+    t.suspects = t.suspects[:0]
+}
+
+// The number of heartbeats a change gets piggybacked on, which grows with the
+// log of the cluster size so that it reaches everyone with high probability
+func (t *Table) retransmitLimit() int {
+    limit := 1
+    for n := len(t.Members); n > 1; n >>= 1 {
+        limit++
+    }
+    return RetransmitMult * limit
+}
+
+// Queue a member's entry to be piggybacked. An entry that is already queued
+// keeps its count, otherwise members that heartbeat constantly would never
+// leave the queue and crowd everyone else out.
+func (t *Table) queueUpdate(id ID) {
+    if _, queued := t.updates[id]; queued || id == t.myID {
+        return
+    }
+    t.updates[id] = t.retransmitLimit()
+}
+
+// Returns our own entry plus the queued entries that were piggybacked the
+// longest time ago, and counts this as one transmission of each of them
+func (t *Table) piggyback() []Member {
+    pending := make([]ID, 0, len(t.updates))
+    for id := range t.updates {
+        mem, exists := t.Members[id]
+        if !exists || (mem.IsFailed && !mem.Evicted) {
+            delete(t.updates, id)
+            continue
+        }
+        pending = append(pending, id)
+    }
+
+    // Send the freshest news first, then rotate through the rest of the queue;
+    // break ties on the ID so the choice is stable
+    sort.Slice(pending, func(i, j int) bool {
+        a, b := pending[i], pending[j]
+        if t.Members[a].lastHeard != t.Members[b].lastHeard {
+            return t.Members[a].lastHeard > t.Members[b].lastHeard
+        }
+        if t.lastSent[a] != t.lastSent[b] {
+            return t.lastSent[a] < t.lastSent[b]
+        }
+        return idLess(a, b)
+    })
+    if len(pending) > MaxPiggyback {
+        pending = pending[:MaxPiggyback]
+    }
+
+    data := make([]Member, 0, len(pending) + 1)
+    data = append(data, t.Members[t.myID])
+    for _, id := range pending {
+        data = append(data, t.Members[id])
+        t.lastSent[id] = t.heartbeats
+        t.updates[id]--
+        if t.updates[id] <= 0 {
+            delete(t.updates, id)
+        }
+    }
+    return data
+}
+
+func (t *Table) MergeTables(members []Member) {
+    t.lock()
+    defer t.unlock()
+    t.mergeTables(members)
+}
+
+func (t *Table) mergeTables(members []Member) {
+    // apply the offsets of timeOffsetss to the members array
+    for _, member := range members {
+        t.mergeMember(member)
+    }
+}
+
+func (t *Table) RPCGetActiveMembers(dummy int, members *[]Member) error {
+    *members = t.ActiveMembers()
+    return nil
+}
+
+func (t *Table) RpcUpdate(members []Member, dummy *int) error {
+    // a second parameter as a pointer is needed, but i have no use for it
+    t.Receive(members)
+    *dummy = 0
+    return nil
+}
+
+// Merge entries that arrived from a peer
+func (t *Table) Receive(members []Member) {
+    t.lock()
+    defer t.unlock()
+    t.receive(members)
+}
+
+func (t *Table) receive(members []Member) {
+    atomic.AddInt64(&t.metrics.received, 1)
+    t.mergeTables(members)
+    t.removeDead()
+}
+
+// Merge a ping and return the entry to answer it with
+func (t *Table) ReceivePing(members []Member) Member {
+    t.lock()
+    defer t.unlock()
+    t.receive(members)
+    return t.Members[t.myID]
+}
+
+func (t *Table) Update(r io.Reader) error {
+    // read the input of a Table.Write
+    // merge the results into t.Members; only heartbeat counters are compared,
+    // never the sender's clock
+    // remove the dead
+    dec := gob.NewDecoder(r)
+
+    var memberArray []Member
+    err := dec.Decode(&memberArray)
+    if err != nil {
+        return err
+    }
+
+    t.lock()
+    defer t.unlock()
+    t.mergeTables(memberArray)
+    t.removeDead()
+    return nil
+}
+
+func IncrementIDFile(filename string) (IDNum, error) {
+    f, err := os.OpenFile(filename, os.O_RDWR | os.O_CREATE, os.ModePerm)
+    if err != nil {
+        return 0, err
+    }
+
+    defer f.Close()
+
+    fi, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+
+    // A zero file size means there was no ID file, so we should create one with the second ID
+    // (which is 1) and return the starting ID (which is 1).
+    if fi.Size() == 0 {
+        err = binary.Write(f, binary.BigEndian, IDNum(1))
+        return 0, err
+    }
+
+    // Read the id which we will return
+    var id IDNum
+    if err = binary.Read(f, binary.BigEndian, &id); err != nil {
+        return 0, err
+    }
+
+    // Move to the beginning of the file and erase it
+    if _, err = f.Seek(0, 0); err != nil {
+        return id, err
+    }
+
+    if err = f.Truncate(0); err != nil {
+        return id, err
+    }
+
+    // Write out what the next id should be, but do not return it
+    err = binary.Write(f, binary.BigEndian, IDNum(id + 1))
+    return id, err
+}
+
+// Load the ID number and last incarnation stored in the given file, and store
+// the next incarnation in it. A restarted member keeps its address and only its
+// incarnation goes up. The ID number is 0 unless the file was written by
+// IncrementIDFile, so it is not unique: members are told apart by address, and
+// the number only breaks ties when ordering them.
+func NextIncarnation(filename string) (IDNum, int64, error) {
+    var stored struct {
+        Num IDNum
+        Incarnation int64
+    }
+
+    data, err := ioutil.ReadFile(filename)
+    if err != nil && !os.IsNotExist(err) {
+        return 0, 0, err
+    }
+    switch len(data) {
+    case 0:
+        // never run before
+    case 4:
+        // written by IncrementIDFile; keep the number it handed out last
+        if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &stored.Num); err != nil {
+            return 0, 0, err
+        }
+        stored.Num--
+    default:
+        if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &stored); err != nil {
+            return 0, 0, err
+        }
+        stored.Incarnation++
+    }
+
+    // Write to a temporary file and rename it over the old one, so a crash
+    // leaves either the old or the new contents but never a partial file
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.BigEndian, stored)
+    tmpName := filename + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return 0, 0, err
+    }
+    if _, err = f.Write(buf.Bytes()); err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        return 0, 0, err
+    }
+    if err = os.Rename(tmpName, filename); err != nil {
+        return 0, 0, err
+    }
+    return stored.Num, stored.Incarnation, nil
+}
+
+////////////// Heartbeating ////////////////////
+
+// Sends the full table to the given address. Used for joining and for the
+// periodic anti-entropy sync.
+func (t *Table) SendHeartbeatToAddress(addr string) error {
+    t.lock()
+    members := t.gossipMembers()
+    transport := t.transport()
+    t.unlock()
+    return t.send(transport, message{kindSync, addr, members})
+}
+
+func (t *Table) SendHeartbeat() error {
+    t.lock()
+    alone := !t.sendHeartbeat()
+    err := t.unlock()
+    if alone {
+        t.reseed()
+    }
+    return err
+}
+
+// Queue a heartbeat to a random member. Returns false if there is nobody to
+// send it to.
+func (t *Table) sendHeartbeat() bool {
+    // Get a list of members we can send our hearbeat to
+    memberList := t.activeMembers()
+
+    // We are alone on this earth :(
+    if len(memberList) == 0 || (len(memberList) == 1 && memberList[0].ID == t.myID) {
+        log.Println("So allooone")
+        return false
+    }
+
+    // Choose a member at random and send their heartbeat
+    var sendToMember *Member
+    for sendToMember == nil || sendToMember.ID == t.myID {
+        sendToMember = &memberList[t.randInt() % len(memberList)]
+    }
+
+    // Usually only our own heartbeat and recent changes get sent, but every so
+    // often we send everything
+    if t.heartbeats % FullSyncInterval == 0 {
+        t.post(kindSync, sendToMember.ID.Address, t.gossipMembers())
+    } else {
+        t.post(kindHeartbeat, sendToMember.ID.Address, t.piggyback())
+    }
+    return true
+}
+
+// Bump our own heartbeat and gossip it to someone. Called once every
+// HeartbeatInterval. Does nothing once we have been evicted.
+func (t *Table) Tick() error {
+    t.lock()
+    if t.evicted {
+        t.unlock()
+        return nil
+    }
+    mem := t.Members[t.myID]
+    mem.HeartbeatID++
+    mem.lastHeard = t.now()
+    t.Members[t.myID] = mem
+    t.heartbeats++
+    t.notifySuspects()
+    t.probeSuspected()
+    t.saveSnapshotPeriodically()
+    alone := !t.sendHeartbeat()
+    err := t.unlock()
+    if alone {
+        t.reseed()
+    }
+    return err
+}
+
+func (t *Table) wasEvicted() bool {
+    t.lock()
+    defer t.unlock()
+    return t.evicted
+}
+
+// Heartbeat until we are evicted
+func (t *Table) SendHeartbeatProcess(fatalChan chan bool) {
+    for !t.wasEvicted() {
+        err := t.Tick()
+        if err != nil {
+            log.Println(err)
+        }
+        time.Sleep(HeartbeatInterval)
+    }
+    fatalChan <- true
+}
+
@@ -0,0 +1,186 @@
+package membertable_test
+
+import (
+    "membertable"
+    "testing"
+)
+
+// A clock that only moves when told to
+type manualClock struct {
+    now membertable.Timestamp
+}
+
+func (c *manualClock) Now() membertable.Timestamp {
+    return c.now
+}
+
+func newTable(clock *manualClock) *membertable.Table {
+    var table membertable.Table
+    table.Clock = clock
+    table.Init(membertable.ID{Num: 100, Name: "me", Address: "1.1.1.100:7777"})
+    return &table
+}
+
+func member(num membertable.IDNum, name string, address string, heartbeat int64) membertable.Member {
+    return membertable.Member{
+        ID: membertable.ID{Num: num, Name: name, Address: address},
+        HeartbeatID: heartbeat,
+    }
+}
+
+func TestJoinMember(t *testing.T) {
+    table := newTable(&manualClock{})
+
+    mem := member(1, "Cool", "107.11.112.1:8888", 1)
+    table.JoinMember(&mem)
+
+    if _, exists := table.Members[mem.ID]; !exists {
+        t.Error("Did not add the member to the map")
+    }
+
+    if table.IsDead(mem.ID) {
+        t.Error("Member 1 added, but initialized wrong")
+    }
+}
+
+func TestMerge(t *testing.T) {
+    clock := &manualClock{now: 10}
+    table := newTable(clock)
+
+    // try to add members
+    inputArray := []membertable.Member{
+        member(0, "alpha", "1.1.1.1", 1),
+        member(1, "beta", "1.1.1.2", 1),
+        member(2, "delta", "1.1.1.3", 1),
+        member(3, "gamma", "1.1.1.4", 1),
+    }
+    table.MergeTables(inputArray)
+
+    for _, mem := range inputArray {
+        if _, exists := table.Members[mem.ID]; !exists {
+            t.Error("Member", mem.ID.Num, "not added")
+        }
+        if table.GetTime(mem.ID) != 10 {
+            t.Error("Member", mem.ID.Num, "added at the wrong time")
+        }
+    }
+
+    // try to update members; only newer heartbeats count
+    clock.now = 20
+    inputArray[0].HeartbeatID = 5
+    inputArray[1].HeartbeatID = 6
+    inputArray[2].HeartbeatID = 0
+    inputArray[3].HeartbeatID = 0
+    table.MergeTables(inputArray)
+
+    if table.GetTime(inputArray[0].ID) != 20 || table.Members[inputArray[0].ID].HeartbeatID != 5 {
+        t.Error("ID 0 not updated")
+    }
+
+    if table.GetTime(inputArray[1].ID) != 20 || table.Members[inputArray[1].ID].HeartbeatID != 6 {
+        t.Error("ID 1 not updated")
+    }
+
+    if table.GetTime(inputArray[2].ID) != 10 {
+        t.Error("ID 2 time not in the first merge")
+    }
+
+    if table.GetTime(inputArray[3].ID) != 10 {
+        t.Error("ID 3 time not in the first merge")
+    }
+}
+
+func TestRemoveDead(t *testing.T) {
+    clock := &manualClock{}
+    table := newTable(clock)
+
+    alpha := member(0, "alpha", "1.1.1.1", 0)
+    beta := member(1, "beta", "1.1.1.2", 0)
+    table.MergeMember(alpha)
+    table.MergeMember(beta)
+
+    clock.now += membertable.TFail + 1
+
+    delta := member(3, "delta", "1.1.1.3", 0)
+    table.MergeMember(delta)
+
+    table.RemoveDead()
+
+    if !table.IsDead(alpha.ID) {
+        t.Error("Member0 is still in the table")
+    }
+
+    if !table.IsDead(beta.ID) {
+        t.Error("Member1 is still in the table")
+    }
+
+    if table.IsDead(delta.ID) {
+        t.Error("Member3 is not in the table, but should be")
+    }
+
+    // Failed members are kept around until TDrop so their failure is not
+    // undone by old gossip
+    if _, exists := table.Members[alpha.ID]; !exists {
+        t.Error("Member0 was dropped before TDrop")
+    }
+
+    clock.now += membertable.TDrop
+    table.RemoveDead()
+
+    if _, exists := table.Members[alpha.ID]; exists {
+        t.Error("Member0 was not dropped after TDrop")
+    }
+}
+
+func TestIsFailed(t *testing.T) {
+    clock := &manualClock{}
+    table := newTable(clock)
+
+    alpha := member(0, "alpha", "1.1.1.1", 0)
+    beta := member(1, "beta", "1.1.1.2", 0)
+    table.MergeMember(alpha)
+    table.MergeMember(beta)
+
+    if table.IsDead(alpha.ID) {
+        t.Error("ID 0 died early")
+    }
+
+    if table.IsDead(beta.ID) {
+        t.Error("ID 1 died early")
+    }
+
+    clock.now += membertable.TFail + 1
+    table.RemoveDead()
+
+    if !table.IsDead(alpha.ID) {
+        t.Error("ID 0 should be dead")
+    }
+
+    if !table.IsDead(beta.ID) {
+        t.Error("ID 1 should be dead")
+    }
+}
+
+func TestChangedCallback(t *testing.T) {
+    clock := &manualClock{}
+    table := newTable(clock)
+
+    var changes [][]membertable.ID
+    var drops []bool
+    table.Changed = func(tbl *membertable.Table, changed []membertable.ID, dropped bool) {
+        changes = append(changes, changed)
+        drops = append(drops, dropped)
+    }
+
+    alpha := member(0, "alpha", "1.1.1.1", 0)
+    table.MergeMember(alpha)
+    if len(changes) != 1 || drops[0] || changes[0][0] != alpha.ID {
+        t.Fatal("join reported as", changes, drops)
+    }
+
+    clock.now += membertable.TFail + 1
+    table.RemoveDead()
+    if len(changes) != 2 || !drops[1] || changes[1][0] != alpha.ID {
+        t.Fatal("failure reported as", changes, drops)
+    }
+}
@@ -0,0 +1,134 @@
+package membertable
+
+import (
+    "sort"
+    "strings"
+)
+
+// Tags with a meaning shared across the system
+const (
+    TagZone = "zone"
+    TagRack = "rack"
+    // relative share of the KV ring a member should own
+    TagWeight = "weight"
+    // comma separated roles, like kv, grep or coordinator
+    TagRoles = "roles"
+    TagBuild = "build"
+    // where a grep node answers log queries, if not on its membership host
+    // and the grep tool's default port
+    TagGrepAddress = "grep.address"
+)
+
+// Roles listed in TagRoles
+const (
+    RoleKV = "kv"
+    RoleGrep = "grep"
+    RoleCoordinator = "coordinator"
+)
+
+// Metadata a member publishes about itself. Only the member changes its own
+// and it bumps Version every time, so the highest version is the newest.
+// Tags is never modified in place, since copies of a Member share it.
+type Meta struct {
+    Version int64
+    Tags map[string]string
+}
+
+func (m Member) Tag(key string) string {
+    return m.Meta.Tags[key]
+}
+
+// A member without a roles tag takes on every role
+func (m Member) HasRole(role string) bool {
+    roles, tagged := m.Meta.Tags[TagRoles]
+    if !tagged {
+        return true
+    }
+    for _, r := range strings.Split(roles, ",") {
+        if strings.TrimSpace(r) == role {
+            return true
+        }
+    }
+    return false
+}
+
+// Parse tags written as space separated key=value pairs, like
+// "zone=east rack=r12 roles=kv,grep"
+func ParseTags(s string) map[string]string {
+    tags := make(map[string]string)
+    for _, pair := range strings.Fields(s) {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) == 2 {
+            tags[kv[0]] = kv[1]
+        } else {
+            tags[kv[0]] = ""
+        }
+    }
+    return tags
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+    keys := make([]string, 0, len(tags))
+    for key := range tags {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// Replace our own tags. The new version is gossiped with our next heartbeat.
+func (t *Table) SetTags(tags map[string]string) {
+    t.lock()
+    defer t.unlock()
+    t.setTags(tags)
+}
+
+func (t *Table) setTags(tags map[string]string) {
+    copied := make(map[string]string, len(tags))
+    for key, value := range tags {
+        copied[key] = value
+    }
+    me := t.Members[t.myID]
+    me.Meta = Meta{me.Meta.Version + 1, copied}
+    t.Members[t.myID] = me
+}
+
+func (t *Table) SetTag(key, value string) {
+    t.lock()
+    defer t.unlock()
+    tags := make(map[string]string)
+    for k, v := range t.Members[t.myID].Meta.Tags {
+        tags[k] = v
+    }
+    tags[key] = value
+    t.setTags(tags)
+}
+
+// The active members keep returns true for
+func (t *Table) ActiveMembersWhere(keep func(Member) bool) []Member {
+    members := t.ActiveMembers()
+    kept := members[:0]
+    for _, mem := range members {
+        if keep(mem) {
+            kept = append(kept, mem)
+        }
+    }
+    return kept
+}
+
+func (t *Table) ActiveMembersWithRole(role string) []Member {
+    return t.ActiveMembersWhere(func(m Member) bool {
+        return m.HasRole(role)
+    })
+}
+
+func (t *Table) ActiveMembersWithTag(key, value string) []Member {
+    return t.ActiveMembersWhere(func(m Member) bool {
+        return m.Tag(key) == value
+    })
+}
+
+func (t *Table) RPCGetActiveMembersWithRole(role string, members *[]Member) error {
+    *members = t.ActiveMembersWithRole(role)
+    return nil
+}
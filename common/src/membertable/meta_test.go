@@ -0,0 +1,44 @@
+package membertable
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestMetaGossip(t *testing.T) {
+    var a, b Table
+    a.Init(ID{Num: 1, Address: "a:1"})
+    b.Init(ID{Num: 2, Address: "b:1"})
+    a.SetTags(ParseTags("rack=r1 roles=kv,grep"))
+
+    // Tags go over UDP along with everything else
+    kind, members, err := decodePacket(encodePacket(packetHeartbeat, a.piggyback()))
+    if err != nil || kind != packetHeartbeat {
+        t.Fatal("decode failed:", kind, err)
+    }
+    b.Receive(members)
+    got := b.Members[a.MyID()]
+    if got.Meta.Version != 1 || !reflect.DeepEqual(got.Meta.Tags, map[string]string{"rack": "r1", "roles": "kv,grep"}) {
+        t.Fatalf("b has metadata %+v", got.Meta)
+    }
+
+    // A newer version replaces it even without a newer heartbeat, and an older
+    // one is ignored
+    old := a.Members[a.MyID()]
+    a.SetTag(TagRoles, "kv")
+    b.MergeMember(a.Members[a.MyID()])
+    b.MergeMember(old)
+    if b.Members[a.MyID()].HasRole(RoleGrep) {
+        t.Error("b still thinks a has the grep role")
+    }
+
+    if kv := b.ActiveMembersWithRole(RoleKV); len(kv) != 2 {
+        t.Errorf("%v members with the kv role, want both", len(kv))
+    }
+    if grep := b.ActiveMembersWithRole(RoleGrep); len(grep) != 1 || grep[0].ID != b.MyID() {
+        t.Errorf("members with the grep role are %v, want only the untagged one", grep)
+    }
+    if racked := b.ActiveMembersWithTag(TagRack, "r1"); len(racked) != 1 {
+        t.Errorf("%v members in rack r1, want 1", len(racked))
+    }
+}
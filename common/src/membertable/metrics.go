@@ -0,0 +1,153 @@
+package membertable
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Message kinds counted separately in the metrics
+const (
+    kindHeartbeat = iota
+    kindSync
+    kindPing
+    kindSuspect
+    numKinds
+)
+
+var kindNames = [numKinds]string{"heartbeat", "sync", "ping", "suspect"}
+
+// Buckets for time between heartbeats and for detection latency, in seconds.
+// Spread around TFail so the histograms show how much headroom it leaves.
+var secondsBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 1.5, 2, 2.5, 3, 5, 10}
+
+// Buckets for the number of entries in a message and bytes in a packet
+var entriesBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256}
+var bytesBuckets = []float64{64, 128, 256, 512, 1024, 1400}
+
+type histogram struct {
+    buckets []float64
+    counts []int64
+    sum float64
+    count int64
+    mutex sync.Mutex
+}
+
+func newHistogram(buckets []float64) *histogram {
+    return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    for i, bound := range h.buckets {
+        if v <= bound {
+            h.counts[i]++
+        }
+    }
+    h.sum += v
+    h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+    for i, bound := range h.buckets {
+        fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+    }
+    fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+    fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// Counters are bumped from RPC and UDP goroutines as well as the heartbeat
+// loop, so they are only touched atomically
+type metrics struct {
+    sent [numKinds]int64
+    sendErrors [numKinds]int64
+    received int64
+    refutations int64
+    falsePositives int64
+    failures int64
+    evictions int64
+
+    // set by RemoveDead, which sees every member anyway
+    alive int64
+    failed int64
+
+    heartbeatGap *histogram
+    detectionLatency *histogram
+    messageEntries *histogram
+    packetBytes *histogram
+}
+
+func newMetrics() *metrics {
+    return &metrics{
+        heartbeatGap: newHistogram(secondsBuckets),
+        detectionLatency: newHistogram(secondsBuckets),
+        messageEntries: newHistogram(entriesBuckets),
+        packetBytes: newHistogram(bytesBuckets),
+    }
+}
+
+func seconds(t Timestamp) float64 {
+    return time.Duration(t).Seconds()
+}
+
+// Count a message of the given kind that we tried to send
+func (t *Table) countSent(kind int, entries int, err error) {
+    atomic.AddInt64(&t.metrics.sent[kind], 1)
+    if err != nil {
+        atomic.AddInt64(&t.metrics.sendErrors[kind], 1)
+    }
+    t.metrics.messageEntries.observe(float64(entries))
+}
+
+func writeCounter(w io.Writer, name, help string, value int64) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+func writeKinds(w io.Writer, name, help string, values *[numKinds]int64) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+    for kind := range values {
+        fmt.Fprintf(w, "%s{kind=\"%s\"} %d\n", name, kindNames[kind], atomic.LoadInt64(&values[kind]))
+    }
+}
+
+// Write every metric in the Prometheus text format
+func (t *Table) WriteMetrics(w io.Writer) {
+    m := t.metrics
+    writeKinds(w, "membertable_messages_sent_total", "Gossip messages sent, by kind.", &m.sent)
+    writeKinds(w, "membertable_send_errors_total", "Gossip messages that could not be sent, by kind.", &m.sendErrors)
+    writeCounter(w, "membertable_messages_received_total", "Gossip messages received.", atomic.LoadInt64(&m.received))
+    writeCounter(w, "membertable_refutations_total", "Times we refuted being marked failed.", atomic.LoadInt64(&m.refutations))
+    writeCounter(w, "membertable_false_positives_total", "Members we marked failed that came back with a new incarnation.", atomic.LoadInt64(&m.falsePositives))
+    writeCounter(w, "membertable_failures_detected_total", "Members we marked failed.", atomic.LoadInt64(&m.failures))
+    writeCounter(w, "membertable_evictions_total", "Members we marked evicted.", atomic.LoadInt64(&m.evictions))
+    fmt.Fprintf(w, "# HELP membertable_members Members in the table, by state.\n# TYPE membertable_members gauge\n")
+    fmt.Fprintf(w, "membertable_members{state=\"alive\"} %d\n", atomic.LoadInt64(&m.alive))
+    fmt.Fprintf(w, "membertable_members{state=\"failed\"} %d\n", atomic.LoadInt64(&m.failed))
+    writeGauge(w, "membertable_tfail_seconds", "The failure timeout in use.", seconds(TFail))
+    m.heartbeatGap.write(w, "membertable_heartbeat_gap_seconds", "Time between new heartbeats from the same member.")
+    m.detectionLatency.write(w, "membertable_detection_latency_seconds", "Time from last hearing from a member to marking it failed.")
+    m.messageEntries.write(w, "membertable_message_entries", "Entries in each gossip message sent.")
+    m.packetBytes.write(w, "membertable_udp_packet_bytes", "Size of each UDP packet sent.")
+}
+
+func (t *Table) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    t.WriteMetrics(w)
+}
+
+// Serve the metrics at /metrics on the default mux, next to the RPC handlers
+// rpc.HandleHTTP installs
+func (t *Table) HandleMetrics() {
+    http.HandleFunc("/metrics", t.ServeMetrics)
+}
@@ -0,0 +1,91 @@
+package membertable
+
+import (
+    "log"
+)
+
+// What this member knows about how much of the cluster it can reach
+type PartitionStatus struct {
+    Active int
+    Expected int
+    Quorum int
+    Minority bool
+}
+
+// How many members the cluster should have: ExpectedSize if it was set,
+// otherwise the most members we have ever seen alive at once
+func (t *Table) expectedSize() int {
+    if t.ExpectedSize > 0 {
+        return t.ExpectedSize
+    }
+    return t.largestSize
+}
+
+// Forget the largest size seen so far, e.g. after members were removed from
+// the cluster for good
+func (t *Table) ResetExpectedSize() {
+    t.lock()
+    defer t.unlock()
+    t.largestSize = 0
+    t.checkPartition()
+}
+
+func (t *Table) Partition() PartitionStatus {
+    t.lock()
+    defer t.unlock()
+    t.removeDead()
+    return t.partitionStatus()
+}
+
+func (t *Table) partitionStatus() PartitionStatus {
+    active := 0
+    for _, mem := range t.Members {
+        if !mem.IsFailed {
+            active++
+        }
+    }
+    expected := t.expectedSize()
+    if expected < active {
+        expected = active
+    }
+    quorum := expected / 2 + 1
+    return PartitionStatus{
+        Active: active,
+        Expected: expected,
+        Quorum: quorum,
+        Minority: active < quorum,
+    }
+}
+
+// True when we can only reach a minority of the cluster, so whatever we
+// decide may be contradicted by the other side of a partition
+func (t *Table) InMinority() bool {
+    return t.Partition().Minority
+}
+
+// Update the largest size seen and log whenever we cross the quorum line
+func (t *Table) checkPartition() {
+    status := t.partitionStatus()
+    if status.Active > t.largestSize {
+        t.largestSize = status.Active
+    }
+    if status.Minority && !t.minority {
+        log.Printf("minority partition: only %v of %v members reachable, quorum is %v",
+                   status.Active, status.Expected, status.Quorum)
+    }
+    if !status.Minority && t.minority {
+        log.Printf("quorum regained: %v of %v members reachable", status.Active, status.Expected)
+    }
+    t.minority = status.Minority
+}
+
+func (t *Table) RPCGetPartitionStatus(dummy int, status *PartitionStatus) error {
+    *status = t.Partition()
+    return nil
+}
+
+func (t *Table) RPCResetExpectedSize(dummy int, status *PartitionStatus) error {
+    t.ResetExpectedSize()
+    *status = t.Partition()
+    return nil
+}
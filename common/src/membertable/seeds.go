@@ -0,0 +1,127 @@
+package membertable
+
+import (
+    "errors"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// While alone, we go back to the seeds after this many heartbeats, doubling
+// each time nobody answers up to ReseedMax
+const ReseedMin = 25
+const ReseedMax = 25 * 32
+
+var (
+    ErrNoSeeds = errors.New("no seeds could be reached")
+)
+
+// Swapped out by tests
+var lookupHost = net.LookupHost
+var lookupSRV = net.LookupSRV
+
+// Split a comma separated list of seeds
+func ParseSeeds(s string) []string {
+    var seeds []string
+    for _, seed := range strings.Split(s, ",") {
+        if seed = strings.TrimSpace(seed); seed != "" {
+            seeds = append(seeds, seed)
+        }
+    }
+    return seeds
+}
+
+// Expand a seed into the addresses behind it. A seed is either host:port,
+// where every address the host resolves to is used, or the name of a DNS SRV
+// record like _membership._tcp.example.com, which lists hosts and ports.
+func resolveSeed(seed string) []string {
+    if strings.HasPrefix(seed, "_") {
+        _, records, err := lookupSRV("", "", seed)
+        if err != nil {
+            log.Println("could not look up seed", seed, ":", err)
+            return nil
+        }
+        var addrs []string
+        for _, srv := range records {
+            target := strings.TrimSuffix(srv.Target, ".")
+            addrs = append(addrs, resolveSeed(net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))...)
+        }
+        return addrs
+    }
+
+    host, port, err := net.SplitHostPort(seed)
+    if err != nil || host == "" || net.ParseIP(host) != nil {
+        return []string{seed}
+    }
+    hosts, err := lookupHost(host)
+    if err != nil {
+        log.Println("could not look up seed", seed, ":", err)
+        return nil
+    }
+    addrs := make([]string, 0, len(hosts))
+    for _, h := range hosts {
+        addrs = append(addrs, net.JoinHostPort(h, port))
+    }
+    return addrs
+}
+
+// Every address the seeds stand for, in the order given, followed by members
+// loaded from a snapshot, without duplicates or ourselves. DNS is looked up
+// again every time, so a seed host that moved is found at its new address.
+func (t *Table) seedAddresses() []string {
+    t.lock()
+    seeds, suspected := t.Seeds, t.suspectedIDs()
+    seen := map[string]bool{t.myID.Address: true}
+    t.unlock()
+    var addrs []string
+    add := func(addr string) {
+        if !seen[addr] {
+            seen[addr] = true
+            addrs = append(addrs, addr)
+        }
+    }
+    for _, seed := range seeds {
+        for _, addr := range resolveSeed(seed) {
+            add(addr)
+        }
+    }
+    for _, id := range suspected {
+        add(id.Address)
+    }
+    return addrs
+}
+
+// Send our table to the first seed that takes it
+func (t *Table) JoinSeeds() error {
+    for _, addr := range t.seedAddresses() {
+        if err := t.SendHeartbeatToAddress(addr); err != nil {
+            log.Println("seed", addr, "unreachable:", err)
+            continue
+        }
+        log.Println("joined through seed", addr)
+        return nil
+    }
+    return ErrNoSeeds
+}
+
+// Called on every heartbeat we spend alone. Every so often go back to the
+// seeds, in case they were down when we started, we were cut off, or everyone
+// else restarted. The wait doubles while nobody answers.
+func (t *Table) reseed() {
+    t.lock()
+    due := (len(t.Seeds) > 0 || len(t.suspected) > 0) && t.heartbeats >= t.nextReseed
+    t.unlock()
+    if !due {
+        return
+    }
+    joined := t.JoinSeeds() == nil
+    t.lock()
+    defer t.unlock()
+    if joined || t.reseedWait == 0 {
+        t.reseedWait = ReseedMin
+    } else if t.reseedWait < ReseedMax {
+        t.reseedWait *= 2
+    }
+    t.nextReseed = t.heartbeats + t.reseedWait
+}
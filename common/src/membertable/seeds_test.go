@@ -0,0 +1,34 @@
+package membertable
+
+import (
+    "errors"
+    "net"
+    "reflect"
+    "testing"
+)
+
+func TestSeedAddresses(t *testing.T) {
+    defer func(host func(string) ([]string, error), srv func(string, string, string) (string, []*net.SRV, error)) {
+        lookupHost, lookupSRV = host, srv
+    }(lookupHost, lookupSRV)
+
+    lookupHost = func(host string) ([]string, error) {
+        switch host {
+            case "seeds.example.com": return []string{"10.0.0.1", "10.0.0.2"}, nil
+            case "a.example.com": return []string{"10.0.0.3"}, nil
+        }
+        return nil, errors.New("no such host")
+    }
+    lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+        return "", []*net.SRV{{Target: "a.example.com.", Port: 7000}}, nil
+    }
+
+    var table Table
+    table.Init(ID{Num: 1, Address: "10.0.0.2:7777"})
+    table.Seeds = ParseSeeds(" seeds.example.com:7777, missing.example.com:1,10.0.0.9:7777,_membership._tcp.example.com,10.0.0.1:7777")
+
+    want := []string{"10.0.0.1:7777", "10.0.0.9:7777", "10.0.0.3:7000"}
+    if got := table.seedAddresses(); !reflect.DeepEqual(got, want) {
+        t.Errorf("seed addresses are %v, want %v", got, want)
+    }
+}
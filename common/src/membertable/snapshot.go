@@ -0,0 +1,116 @@
+package membertable
+
+import (
+    "encoding/gob"
+    "io"
+    "log"
+    "os"
+    "sort"
+)
+
+// How often the table is saved to SnapshotFile, in heartbeats
+const SnapshotInterval = 125
+
+// How many members loaded from a snapshot get pinged on each heartbeat
+const probesPerHeartbeat = 4
+
+// Write the active members to filename. The snapshot goes to a temporary file
+// that is renamed over the old one, so a crash never leaves half a snapshot.
+func (t *Table) SaveSnapshot(filename string) error {
+    t.lock()
+    members := t.activeMembers()
+    t.unlock()
+    return saveMembers(filename, members)
+}
+
+func saveMembers(filename string, members []Member) error {
+    tmpName := filename + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+    if err = gob.NewEncoder(f).Encode(members); err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmpName, filename)
+}
+
+// Load a snapshot saved by SaveSnapshot. A missing file is not an error.
+func (t *Table) LoadSnapshot(filename string) error {
+    f, err := os.Open(filename)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return t.ReadSnapshot(f)
+}
+
+// Read members written by WriteTo. They are not trusted to be alive: they
+// only become members once they answer a ping or gossip to us, and are
+// forgotten if they haven't within TDrop.
+func (t *Table) ReadSnapshot(r io.Reader) error {
+    var members []Member
+    if err := gob.NewDecoder(r).Decode(&members); err != nil {
+        return err
+    }
+
+    t.lock()
+    defer t.unlock()
+    t.suspected = make(map[ID]Member)
+    for _, mem := range members {
+        if _, exists := t.Members[mem.ID]; !exists && mem.ID != t.myID {
+            t.suspected[mem.ID] = mem
+        }
+    }
+    t.suspectedUntil = t.now() + TDrop
+    log.Println("loaded", len(t.suspected), "members from snapshot")
+    return nil
+}
+
+// The members loaded from a snapshot we have not heard from yet
+func (t *Table) suspectedIDs() []ID {
+    ids := make([]ID, 0, len(t.suspected))
+    for id := range t.suspected {
+        ids = append(ids, id)
+    }
+    sort.Slice(ids, func(i, j int) bool {
+        return idLess(ids[i], ids[j])
+    })
+    return ids
+}
+
+// Ping a few of the members loaded from a snapshot. Anyone alive answers with
+// their entry, which adds them back to the table.
+func (t *Table) probeSuspected() {
+    if len(t.suspected) == 0 {
+        return
+    }
+    if t.now() > t.suspectedUntil {
+        log.Println("giving up on", len(t.suspected), "members from snapshot")
+        t.suspected = nil
+        return
+    }
+
+    ids := t.suspectedIDs()
+    for i := 0; i < probesPerHeartbeat && i < len(ids); i++ {
+        t.probeNext = (t.probeNext + 1) % len(ids)
+        t.post(kindPing, ids[t.probeNext].Address, []Member{t.Members[t.myID]})
+    }
+}
+
+// Save a snapshot every SnapshotInterval heartbeats if there is a file for it
+func (t *Table) saveSnapshotPeriodically() {
+    if t.SnapshotFile == "" || t.heartbeats % SnapshotInterval != 0 {
+        return
+    }
+    if err := saveMembers(t.SnapshotFile, t.activeMembers()); err != nil {
+        log.Println("could not save membership snapshot:", err)
+    }
+}
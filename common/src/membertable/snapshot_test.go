@@ -0,0 +1,39 @@
+package membertable
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestSnapshotFile(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "membertable")
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "members")
+
+    var before Table
+    before.Init(ID{Num: 1, Address: "a:1"})
+    before.MergeMember(Member{ID: ID{Num: 2, Address: "b:1"}, Incarnation: 3, HeartbeatID: 7})
+    if err := before.SaveSnapshot(filename); err != nil {
+        t.Fatal(err)
+    }
+
+    var after Table
+    after.Init(ID{Num: 1, Address: "a:1"})
+    if err := after.LoadSnapshot(filename + ".missing"); err != nil {
+        t.Fatal("a missing snapshot gave", err)
+    }
+    if err := after.LoadSnapshot(filename); err != nil {
+        t.Fatal(err)
+    }
+
+    // Loaded members are only suspected until they answer
+    if len(after.ActiveMembers()) != 1 || len(after.suspected) != 1 {
+        t.Fatalf("after loading, %v active and %v suspected", len(after.ActiveMembers()), len(after.suspected))
+    }
+    after.MergeMember(Member{ID: ID{Num: 2, Address: "b:1"}, Incarnation: 3, HeartbeatID: 8})
+    if len(after.ActiveMembers()) != 2 || len(after.suspected) != 0 {
+        t.Fatalf("after hearing back, %v active and %v suspected", len(after.ActiveMembers()), len(after.suspected))
+    }
+}
@@ -0,0 +1,87 @@
+package membertable
+
+import (
+    "log"
+    "math/rand"
+    "net"
+
+    "rpcpool"
+)
+
+// How a Table talks to its peers. The default sends heartbeats over UDP (or
+// RPC if UDP is not set up) and syncs over RPC; tests swap in a simulated
+// network.
+type Transport interface {
+    // Deliver some entries to addr. Allowed to be lossy.
+    Heartbeat(addr string, members []Member) error
+    // Deliver the full table to addr. Used for joins and anti-entropy.
+    Sync(addr string, members []Member) error
+    // Ask addr to answer with its own entry.
+    Ping(addr string, me Member) error
+}
+
+// Where a Table gets the current time from
+type Clock interface {
+    Now() Timestamp
+}
+
+type systemClock struct{}
+
+func (c systemClock) Now() Timestamp {
+    return StampNow()
+}
+
+// Sends over conn if we listen for UDP
+type netTransport struct {
+    t *Table
+    conn *net.UDPConn
+}
+
+func (n netTransport) Heartbeat(addr string, members []Member) error {
+    if n.conn != nil {
+        return n.t.sendPacket(n.conn, addr, packetHeartbeat, members)
+    }
+    return sendMembersRPC(addr, members)
+}
+
+func (n netTransport) Sync(addr string, members []Member) error {
+    return sendMembersRPC(addr, members)
+}
+
+func (n netTransport) Ping(addr string, me Member) error {
+    if n.conn != nil {
+        return n.t.sendPacket(n.conn, addr, packetPing, []Member{me})
+    }
+    return sendMembersRPC(addr, []Member{me})
+}
+
+func sendMembersRPC(addr string, data []Member) error {
+    var reply int
+    callErr := rpcpool.Default.Call(addr, "Table.RpcUpdate", data, &reply)
+    if callErr != nil {
+        log.Print("Error while sending heardbeat")
+        return callErr
+    }
+    return nil
+}
+
+func (t *Table) transport() Transport {
+    if t.Transport != nil {
+        return t.Transport
+    }
+    return netTransport{t, t.udpConn}
+}
+
+func (t *Table) now() Timestamp {
+    if t.Clock != nil {
+        return t.Clock.Now()
+    }
+    return StampNow()
+}
+
+func (t *Table) randInt() int {
+    if t.Rand != nil {
+        return t.Rand.Int()
+    }
+    return rand.Int()
+}
@@ -0,0 +1,232 @@
+package membertable
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "log"
+    "net"
+)
+
+// Heartbeat packets are kept under a typical ethernet MTU so they never get
+// fragmented
+const MaxPacketSize = 1400
+
+const packetVersion = uint8(3)
+
+// bits in a member's flags byte
+const flagFailed = uint8(1)
+const flagEvicted = uint8(2)
+
+const (
+    packetHeartbeat = uint8(iota + 1)
+    packetPing
+    packetAck
+)
+
+var (
+    ErrBadPacket = errors.New("malformed membership packet")
+)
+
+// Packet layout (big endian):
+//   version uint8, kind uint8, count uint16
+//   count times: num int32, incarnation int64, heartbeat int64, flags uint8,
+//                name length uint8, name, address length uint8, address,
+//                meta version int64, tag count uint8,
+//                tag count times: key length uint8, key, value length uint8, value
+// Members that do not fit in MaxPacketSize are left off, and so are tags too
+// long to encode.
+func encodePacket(kind uint8, members []Member) []byte {
+    var buf bytes.Buffer
+    buf.WriteByte(packetVersion)
+    buf.WriteByte(kind)
+    buf.Write([]byte{0, 0})
+
+    count := uint16(0)
+    for _, mem := range members {
+        name, addr := mem.ID.Name, mem.ID.Address
+        if len(name) > 255 || len(addr) > 255 {
+            continue
+        }
+        var tags []string
+        for _, key := range sortedTagKeys(mem.Meta.Tags) {
+            if len(key) <= 255 && len(mem.Meta.Tags[key]) <= 255 && len(tags) < 255 {
+                tags = append(tags, key)
+            }
+        }
+        size := 4 + 8 + 8 + 1 + 1 + len(name) + 1 + len(addr) + 8 + 1
+        for _, key := range tags {
+            size += 1 + len(key) + 1 + len(mem.Meta.Tags[key])
+        }
+        if buf.Len() + size > MaxPacketSize {
+            break
+        }
+        binary.Write(&buf, binary.BigEndian, int32(mem.ID.Num))
+        binary.Write(&buf, binary.BigEndian, mem.Incarnation)
+        binary.Write(&buf, binary.BigEndian, mem.HeartbeatID)
+        flags := uint8(0)
+        if mem.IsFailed {
+            flags |= flagFailed
+        }
+        if mem.Evicted {
+            flags |= flagEvicted
+        }
+        buf.WriteByte(flags)
+        buf.WriteByte(uint8(len(name)))
+        buf.WriteString(name)
+        buf.WriteByte(uint8(len(addr)))
+        buf.WriteString(addr)
+        binary.Write(&buf, binary.BigEndian, mem.Meta.Version)
+        buf.WriteByte(uint8(len(tags)))
+        for _, key := range tags {
+            buf.WriteByte(uint8(len(key)))
+            buf.WriteString(key)
+            value := mem.Meta.Tags[key]
+            buf.WriteByte(uint8(len(value)))
+            buf.WriteString(value)
+        }
+        count++
+    }
+
+    packet := buf.Bytes()
+    binary.BigEndian.PutUint16(packet[2:4], count)
+    return packet
+}
+
+func decodePacket(packet []byte) (uint8, []Member, error) {
+    r := bytes.NewReader(packet)
+    var header struct {
+        Version uint8
+        Kind uint8
+        Count uint16
+    }
+    if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+        return 0, nil, ErrBadPacket
+    }
+    if header.Version != packetVersion {
+        return 0, nil, ErrBadPacket
+    }
+
+    readString := func() (string, error) {
+        length, err := r.ReadByte()
+        if err != nil {
+            return "", err
+        }
+        str := make([]byte, length)
+        if _, err = io.ReadFull(r, str); err != nil {
+            return "", err
+        }
+        return string(str), nil
+    }
+
+    members := make([]Member, 0, header.Count)
+    for i := uint16(0); i < header.Count; i++ {
+        var mem Member
+        var num int32
+        if err := binary.Read(r, binary.BigEndian, &num); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        if err := binary.Read(r, binary.BigEndian, &mem.Incarnation); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        if err := binary.Read(r, binary.BigEndian, &mem.HeartbeatID); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        flags, err := r.ReadByte()
+        if err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        mem.IsFailed = flags & flagFailed != 0
+        mem.Evicted = flags & flagEvicted != 0
+        mem.ID.Num = IDNum(num)
+        if mem.ID.Name, err = readString(); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        if mem.ID.Address, err = readString(); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        if err = binary.Read(r, binary.BigEndian, &mem.Meta.Version); err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        numTags, err := r.ReadByte()
+        if err != nil {
+            return 0, nil, ErrBadPacket
+        }
+        if numTags > 0 {
+            mem.Meta.Tags = make(map[string]string, numTags)
+        }
+        for j := uint8(0); j < numTags; j++ {
+            key, err := readString()
+            if err != nil {
+                return 0, nil, ErrBadPacket
+            }
+            if mem.Meta.Tags[key], err = readString(); err != nil {
+                return 0, nil, ErrBadPacket
+            }
+        }
+        members = append(members, mem)
+    }
+    return header.Kind, members, nil
+}
+
+// Start receiving heartbeats and pings over UDP on the given address. Once
+// this succeeds, heartbeats are sent over UDP instead of RPC.
+func (t *Table) ListenUDP(addr string) error {
+    udpAddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return err
+    }
+    conn, err := net.ListenUDP("udp", udpAddr)
+    if err != nil {
+        return err
+    }
+    t.lock()
+    t.udpConn = conn
+    t.unlock()
+    go t.receiveUDP(conn)
+    return nil
+}
+
+func (t *Table) receiveUDP(conn *net.UDPConn) {
+    buf := make([]byte, MaxPacketSize)
+    for {
+        n, from, err := conn.ReadFromUDP(buf)
+        if err != nil {
+            log.Println("udp receive error:", err)
+            return
+        }
+        kind, members, err := decodePacket(buf[:n])
+        if err != nil {
+            log.Println("dropping packet from", from, ":", err)
+            continue
+        }
+        if kind == packetPing {
+            ack := encodePacket(packetAck, []Member{t.ReceivePing(members)})
+            conn.WriteToUDP(ack, from)
+        } else {
+            t.Receive(members)
+        }
+    }
+}
+
+func (t *Table) sendPacket(conn *net.UDPConn, addr string, kind uint8, members []Member) error {
+    udpAddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return err
+    }
+    packet := encodePacket(kind, members)
+    t.metrics.packetBytes.observe(float64(len(packet)))
+    _, err = conn.WriteToUDP(packet, udpAddr)
+    return err
+}
+
+// Ask the member at the given address to answer with its own entry. The
+// answer is merged like any other heartbeat when it arrives.
+func (t *Table) Ping(addr string) error {
+    t.lock()
+    me := t.Members[t.myID]
+    transport := t.transport()
+    t.unlock()
+    return t.send(transport, message{kindPing, addr, []Member{me}})
+}
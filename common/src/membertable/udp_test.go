@@ -0,0 +1,119 @@
+package membertable
+
+import (
+    "net"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+    members := []Member{
+        {ID: ID{Num: 1, Name: "a", Address: "10.0.0.1:7777"}, Incarnation: 2, HeartbeatID: 300},
+        {ID: ID{Num: -4, Name: "", Address: "10.0.0.2:7777"}, IsFailed: true, Meta: Meta{Version: 5, Tags: map[string]string{"zone": "east", TagRoles: "kv,grep"}}},
+        {ID: ID{Num: 9, Name: "c", Address: "10.0.0.3:7777"}, Incarnation: 1, IsFailed: true, Evicted: true},
+    }
+    kind, got, err := decodePacket(encodePacket(packetPing, members))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if kind != packetPing || !reflect.DeepEqual(got, members) {
+        t.Errorf("decoded kind %v %+v, want %+v", kind, got, members)
+    }
+}
+
+func TestPacketSizeLimit(t *testing.T) {
+    var members []Member
+    for i := 0; i < 100; i++ {
+        members = append(members, Member{ID: ID{Num: IDNum(i), Name: "member", Address: "10.0.0." + strconv.Itoa(i) + ":7777"}})
+    }
+    // A name too long to encode is left off rather than cut short
+    members[1].ID.Name = strings.Repeat("x", 256)
+
+    packet := encodePacket(packetHeartbeat, members)
+    if len(packet) > MaxPacketSize {
+        t.Fatal("packet is", len(packet), "bytes")
+    }
+    _, got, err := decodePacket(packet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(got) == 0 || len(got) >= len(members) - 1 {
+        t.Fatal("packet holds", len(got), "members")
+    }
+    // the ones that fit, in order
+    if got[0].ID != members[0].ID || got[1].ID != members[2].ID {
+        t.Error("packet starts with", got[0].ID, got[1].ID)
+    }
+}
+
+func TestBadPackets(t *testing.T) {
+    packet := encodePacket(packetHeartbeat, []Member{{ID: ID{Num: 1, Name: "a", Address: "10.0.0.1:7777"}, Meta: Meta{Version: 1, Tags: map[string]string{"zone": "east"}}}})
+
+    // Cut anywhere, a packet is rejected instead of giving a partial member
+    for n := 0; n < len(packet); n++ {
+        if _, _, err := decodePacket(packet[:n]); err != ErrBadPacket {
+            t.Errorf("packet cut to %v bytes gave %v", n, err)
+        }
+    }
+
+    wrongVersion := append([]byte(nil), packet...)
+    wrongVersion[0] = packetVersion + 1
+    if _, _, err := decodePacket(wrongVersion); err != ErrBadPacket {
+        t.Error("packet of another version gave", err)
+    }
+}
+
+type discardTransport struct{}
+
+func (discardTransport) Heartbeat(addr string, members []Member) error { return nil }
+func (discardTransport) Sync(addr string, members []Member) error { return nil }
+func (discardTransport) Ping(addr string, me Member) error { return nil }
+
+// Packets are merged on the UDP goroutine while the heartbeat loop and the
+// admin and partition queries use the table; run with -race
+func TestReceiveUDPWhileTicking(t *testing.T) {
+    table := newTable(1)
+    table.Transport = discardTransport{}
+    if err := table.ListenUDP("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer table.udpConn.Close()
+    conn, err := net.Dial("udp", table.udpConn.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    const senders = 10
+    done := make(chan bool)
+    go func() {
+        for i := 0; i < 20 * senders; i++ {
+            num := IDNum(i % senders + 2)
+            mem := Member{ID: ID{Num: num, Address: "host" + strconv.Itoa(int(num))}, HeartbeatID: int64(i)}
+            conn.Write(encodePacket(packetHeartbeat, []Member{mem}))
+            time.Sleep(100 * time.Microsecond)
+        }
+        close(done)
+    }()
+    for ticking := true; ticking; {
+        select {
+            case <-done: ticking = false
+            default:
+        }
+        table.Tick()
+        table.InMinority()
+        table.MemberInfos()
+        table.GetStats()
+    }
+
+    deadline := time.Now().Add(time.Second)
+    for len(table.ActiveMembers()) < senders + 1 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if n := len(table.ActiveMembers()); n != senders + 1 {
+        t.Error("heard from", n - 1, "of", senders, "members")
+    }
+}
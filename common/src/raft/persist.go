@@ -0,0 +1,84 @@
+package raft
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "rpcpool"
+)
+
+// Where a member keeps its term, vote, log and snapshot. Save has to be
+// durable before it returns, since votes and acknowledged entries are
+// promises to the rest of the cluster.
+type Persister interface {
+    Save(state []byte) error
+    Load() ([]byte, error)
+}
+
+// Keeps the state in a single file, replaced atomically on every save
+type FilePersister struct {
+    Filename string
+}
+
+func (p *FilePersister) Save(state []byte) error {
+    tmpName := p.Filename + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+    if _, err = f.Write(state); err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        return err
+    }
+    if err = os.Rename(tmpName, p.Filename); err != nil {
+        return err
+    }
+
+    dir, err := os.Open(filepath.Dir(p.Filename))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return dir.Sync()
+}
+
+// A missing file is an empty state
+func (p *FilePersister) Load() ([]byte, error) {
+    data, err := ioutil.ReadFile(p.Filename)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    return data, err
+}
+
+// Keeps the state in memory, for tests. It survives a member being
+// recreated with the same persister, like a file would.
+type MemoryPersister struct {
+    state []byte
+    mutex sync.Mutex
+}
+
+func (p *MemoryPersister) Save(state []byte) error {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.state = append([]byte(nil), state...)
+    return nil
+}
+
+func (p *MemoryPersister) Load() ([]byte, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.state, nil
+}
+
+// Calls the other members over net/rpc, where they are registered as "Raft"
+type rpcCaller struct{}
+
+func (rpcCaller) Call(addr string, method string, args interface{}, reply interface{}) error {
+    return rpcpool.Default.Call(addr, method, args, reply)
+}
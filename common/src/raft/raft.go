@@ -0,0 +1,877 @@
+// Package raft keeps a replicated log of commands with the Raft consensus
+// algorithm: leader election, log replication, snapshots and single-server
+// membership changes. Members talk to each other over net/rpc, so a member is
+// registered with rpc.Register like any other service.
+//
+// Commands are arbitrary gob-encodable values. Their concrete types have to
+// be registered with gob.Register by the user, since they travel inside an
+// interface{}.
+package raft
+
+import (
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "log"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+const HeartbeatInterval = 50 * time.Millisecond
+
+// Followers wait between ElectionTimeout and twice that without hearing from a
+// leader before they start an election
+const ElectionTimeout = 300 * time.Millisecond
+
+// How long Propose waits for a command to be committed and applied
+const ProposeTimeout = 3 * time.Second
+
+// The most entries sent in a single AppendEntries
+const maxEntriesPerMessage = 64
+
+var (
+    ErrNotLeader = errors.New("not the raft leader")
+    ErrLostLeadership = errors.New("lost leadership before the entry committed")
+    ErrTimeout = errors.New("timed out waiting for the entry to commit")
+    ErrConfigChangePending = errors.New("another membership change is still in progress")
+    ErrNotAPeer = errors.New("this member is not in the raft peer list")
+    ErrPeersChanged = errors.New("the raft peer list differs from the saved membership")
+)
+
+type State int
+
+const (
+    Follower State = iota
+    Candidate
+    Leader
+)
+
+func (s State) String() string {
+    switch s {
+        case Follower: return "follower"
+        case Candidate: return "candidate"
+        case Leader: return "leader"
+    }
+    return "unknown"
+}
+
+const (
+    commandEntry = iota
+    configEntry
+    noopEntry
+)
+
+type Entry struct {
+    Term int64
+    Kind int
+    Command interface{}
+    // the full list of members once this entry is in the log
+    Config []string
+}
+
+// What the replicated log drives. Apply is called once for every committed
+// command, in log order, and must not call back into the Raft.
+type StateMachine interface {
+    Apply(index int64, command interface{}) interface{}
+    Snapshot() ([]byte, error)
+    Restore(snapshot []byte) error
+}
+
+// How RPCs reach the other members
+type Caller interface {
+    Call(addr string, method string, args interface{}, reply interface{}) error
+}
+
+type waiter struct {
+    term int64
+    done chan applyResult
+}
+
+type applyResult struct {
+    value interface{}
+    err error
+}
+
+type Raft struct {
+    // Take a snapshot once this many entries have been applied since the last
+    // one; zero means never
+    SnapshotThreshold int
+    Caller Caller
+
+    me string
+    sm StateMachine
+    persister Persister
+
+    // persistent state
+    currentTerm int64
+    votedFor string
+    log []Entry
+    snapshotIndex int64
+    snapshotTerm int64
+    snapshotConfig []string
+    snapshotData []byte
+
+    // volatile state
+    state State
+    leader string
+    config []string
+    commitIndex int64
+    lastApplied int64
+    electionDeadline time.Time
+    votes int
+
+    // leader state
+    nextIndex map[string]int64
+    matchIndex map[string]int64
+    inflight map[string]bool
+
+    waiters map[int64]waiter
+    stopped bool
+    mutex sync.Mutex
+}
+
+// Create a member named me (its RPC address). peers is the initial
+// membership, which must be the same on every member of a new cluster; a
+// member being added to an existing cluster starts with no peers and waits for
+// the leader to contact it. Any state in persister is loaded first.
+func New(me string, peers []string, sm StateMachine, persister Persister) (*Raft, error) {
+    r := &Raft{
+        SnapshotThreshold: 256,
+        me: me,
+        sm: sm,
+        persister: persister,
+        snapshotConfig: append([]string(nil), peers...),
+        waiters: make(map[int64]waiter),
+    }
+    if err := r.load(); err != nil {
+        return nil, err
+    }
+    if r.snapshotData != nil {
+        if err := sm.Restore(r.snapshotData); err != nil {
+            return nil, err
+        }
+    }
+    r.commitIndex = r.snapshotIndex
+    r.lastApplied = r.snapshotIndex
+    r.config = r.latestConfig()
+    r.resetElectionDeadline()
+    return r, nil
+}
+
+// Like New, for a cluster whose membership never changes: me must be one of
+// peers, and any saved membership must be the same set. Restarting members
+// with different lists could let two majorities elect two leaders.
+func NewFixed(me string, peers []string, sm StateMachine, persister Persister) (*Raft, error) {
+    if !contains(peers, me) {
+        return nil, ErrNotAPeer
+    }
+    r, err := New(me, peers, sm, persister)
+    if err != nil {
+        return nil, err
+    }
+    config := r.Config()
+    if len(config) != len(peers) {
+        return nil, ErrPeersChanged
+    }
+    for _, peer := range peers {
+        if !contains(config, peer) {
+            return nil, ErrPeersChanged
+        }
+    }
+    return r, nil
+}
+
+func contains(list []string, s string) bool {
+    for _, x := range list {
+        if x == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Start the timers that drive elections and heartbeats
+func (r *Raft) Start() {
+    go r.run()
+}
+
+func (r *Raft) Stop() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.stopped = true
+}
+
+func (r *Raft) run() {
+    heartbeat := time.Now()
+    for {
+        time.Sleep(10 * time.Millisecond)
+        r.mutex.Lock()
+        if r.stopped {
+            r.mutex.Unlock()
+            return
+        }
+        if r.state == Leader {
+            if time.Since(heartbeat) >= HeartbeatInterval {
+                heartbeat = time.Now()
+                r.broadcast()
+            }
+        } else if time.Now().After(r.electionDeadline) && r.inConfig(r.me) {
+            r.startElection()
+        }
+        r.mutex.Unlock()
+    }
+}
+
+func (r *Raft) caller() Caller {
+    if r.Caller != nil {
+        return r.Caller
+    }
+    return rpcCaller{}
+}
+
+func (r *Raft) resetElectionDeadline() {
+    timeout := ElectionTimeout + time.Duration(rand.Int63n(int64(ElectionTimeout)))
+    r.electionDeadline = time.Now().Add(timeout)
+}
+
+/////////////// Log indexing ///////////////
+
+func (r *Raft) lastIndex() int64 {
+    return r.snapshotIndex + int64(len(r.log))
+}
+
+func (r *Raft) entry(index int64) Entry {
+    return r.log[index - r.snapshotIndex - 1]
+}
+
+// The term of the entry at index, or -1 if it is not in the log any more
+func (r *Raft) termAt(index int64) int64 {
+    if index == r.snapshotIndex {
+        return r.snapshotTerm
+    }
+    if index < r.snapshotIndex || index > r.lastIndex() {
+        return -1
+    }
+    return r.entry(index).Term
+}
+
+func (r *Raft) lastTerm() int64 {
+    return r.termAt(r.lastIndex())
+}
+
+// The membership as of the newest config entry in the log, which is in
+// effect as soon as it is appended
+func (r *Raft) latestConfig() []string {
+    for i := len(r.log) - 1; i >= 0; i-- {
+        if r.log[i].Kind == configEntry {
+            return r.log[i].Config
+        }
+    }
+    return r.snapshotConfig
+}
+
+// The membership as of the given index
+func (r *Raft) configAt(index int64) []string {
+    for i := index; i > r.snapshotIndex; i-- {
+        if e := r.entry(i); e.Kind == configEntry {
+            return e.Config
+        }
+    }
+    return r.snapshotConfig
+}
+
+func (r *Raft) inConfig(addr string) bool {
+    for _, member := range r.config {
+        if member == addr {
+            return true
+        }
+    }
+    return false
+}
+
+func (r *Raft) majority() int {
+    return len(r.config) / 2 + 1
+}
+
+func (r *Raft) appendEntry(e Entry) int64 {
+    r.log = append(r.log, e)
+    if e.Kind == configEntry {
+        r.config = e.Config
+    }
+    return r.lastIndex()
+}
+
+/////////////// Elections ///////////////
+
+type RequestVoteArgs struct {
+    Term int64
+    Candidate string
+    LastLogIndex int64
+    LastLogTerm int64
+}
+
+type RequestVoteReply struct {
+    Term int64
+    VoteGranted bool
+}
+
+func (r *Raft) becomeFollower(term int64) {
+    if term > r.currentTerm {
+        r.currentTerm = term
+        r.votedFor = ""
+        r.persist()
+    }
+    if r.state != Follower {
+        log.Println("raft: now a follower in term", r.currentTerm)
+    }
+    r.state = Follower
+}
+
+func (r *Raft) startElection() {
+    r.currentTerm++
+    r.state = Candidate
+    r.votedFor = r.me
+    r.votes = 1
+    r.leader = ""
+    r.persist()
+    r.resetElectionDeadline()
+    log.Println("raft: starting election for term", r.currentTerm)
+
+    if r.votes >= r.majority() {
+        r.becomeLeader()
+        return
+    }
+
+    args := RequestVoteArgs{r.currentTerm, r.me, r.lastIndex(), r.lastTerm()}
+    for _, peer := range r.config {
+        if peer == r.me {
+            continue
+        }
+        go r.requestVote(peer, args)
+    }
+}
+
+func (r *Raft) requestVote(peer string, args RequestVoteArgs) {
+    var reply RequestVoteReply
+    if err := r.caller().Call(peer, "Raft.RequestVote", args, &reply); err != nil {
+        return
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if reply.Term > r.currentTerm {
+        r.becomeFollower(reply.Term)
+        return
+    }
+    if r.state != Candidate || r.currentTerm != args.Term || !reply.VoteGranted {
+        return
+    }
+    r.votes++
+    if r.votes >= r.majority() {
+        r.becomeLeader()
+    }
+}
+
+func (r *Raft) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if args.Term > r.currentTerm {
+        r.becomeFollower(args.Term)
+    }
+    reply.Term = r.currentTerm
+    reply.VoteGranted = false
+    if args.Term < r.currentTerm {
+        return nil
+    }
+
+    // Only vote for candidates whose log is at least as new as ours
+    upToDate := args.LastLogTerm > r.lastTerm() ||
+                (args.LastLogTerm == r.lastTerm() && args.LastLogIndex >= r.lastIndex())
+    if (r.votedFor == "" || r.votedFor == args.Candidate) && upToDate {
+        r.votedFor = args.Candidate
+        r.persist()
+        r.resetElectionDeadline()
+        reply.VoteGranted = true
+    }
+    return nil
+}
+
+func (r *Raft) becomeLeader() {
+    log.Println("raft: elected leader for term", r.currentTerm)
+    r.state = Leader
+    r.leader = r.me
+    r.nextIndex = make(map[string]int64)
+    r.matchIndex = make(map[string]int64)
+    r.inflight = make(map[string]bool)
+
+    // Entries from earlier terms only commit once one from our own term does
+    r.appendEntry(Entry{Term: r.currentTerm, Kind: noopEntry})
+    r.persist()
+    r.broadcast()
+}
+
+/////////////// Replication ///////////////
+
+type AppendEntriesArgs struct {
+    Term int64
+    Leader string
+    PrevLogIndex int64
+    PrevLogTerm int64
+    Entries []Entry
+    LeaderCommit int64
+}
+
+type AppendEntriesReply struct {
+    Term int64
+    Success bool
+    // where the leader should back up to after a failure
+    ConflictIndex int64
+}
+
+type InstallSnapshotArgs struct {
+    Term int64
+    Leader string
+    LastIncludedIndex int64
+    LastIncludedTerm int64
+    Config []string
+    Data []byte
+}
+
+type InstallSnapshotReply struct {
+    Term int64
+}
+
+// Send whatever each follower is missing, or just a heartbeat
+func (r *Raft) broadcast() {
+    for _, peer := range r.config {
+        if peer == r.me || r.inflight[peer] {
+            continue
+        }
+        if _, known := r.nextIndex[peer]; !known {
+            r.nextIndex[peer] = r.lastIndex() + 1
+        }
+        r.inflight[peer] = true
+        go r.replicateTo(peer)
+    }
+    r.advanceCommit()
+}
+
+func (r *Raft) replicateTo(peer string) {
+    r.mutex.Lock()
+    defer func() {
+        r.inflight[peer] = false
+        r.mutex.Unlock()
+    }()
+    if r.state != Leader {
+        return
+    }
+    term := r.currentTerm
+
+    next := r.nextIndex[peer]
+    if next <= r.snapshotIndex {
+        args := InstallSnapshotArgs{
+            Term: term,
+            Leader: r.me,
+            LastIncludedIndex: r.snapshotIndex,
+            LastIncludedTerm: r.snapshotTerm,
+            Config: r.snapshotConfig,
+            Data: r.snapshotData,
+        }
+        var reply InstallSnapshotReply
+        r.mutex.Unlock()
+        err := r.caller().Call(peer, "Raft.InstallSnapshot", args, &reply)
+        r.mutex.Lock()
+        if err != nil {
+            return
+        }
+        if reply.Term > r.currentTerm {
+            r.becomeFollower(reply.Term)
+            return
+        }
+        if r.state == Leader && r.currentTerm == term {
+            r.matchIndex[peer] = args.LastIncludedIndex
+            r.nextIndex[peer] = args.LastIncludedIndex + 1
+        }
+        return
+    }
+
+    args := AppendEntriesArgs{
+        Term: term,
+        Leader: r.me,
+        PrevLogIndex: next - 1,
+        PrevLogTerm: r.termAt(next - 1),
+        LeaderCommit: r.commitIndex,
+    }
+    for i := next; i <= r.lastIndex() && len(args.Entries) < maxEntriesPerMessage; i++ {
+        args.Entries = append(args.Entries, r.entry(i))
+    }
+
+    var reply AppendEntriesReply
+    r.mutex.Unlock()
+    err := r.caller().Call(peer, "Raft.AppendEntries", args, &reply)
+    r.mutex.Lock()
+    if err != nil {
+        return
+    }
+    if reply.Term > r.currentTerm {
+        r.becomeFollower(reply.Term)
+        return
+    }
+    if r.state != Leader || r.currentTerm != term {
+        return
+    }
+    if reply.Success {
+        match := args.PrevLogIndex + int64(len(args.Entries))
+        if match > r.matchIndex[peer] {
+            r.matchIndex[peer] = match
+        }
+        r.nextIndex[peer] = match + 1
+        r.advanceCommit()
+    } else {
+        r.nextIndex[peer] = reply.ConflictIndex
+        if r.nextIndex[peer] < 1 {
+            r.nextIndex[peer] = 1
+        }
+    }
+}
+
+// Commit the newest entry from our term that a majority has
+func (r *Raft) advanceCommit() {
+    for index := r.lastIndex(); index > r.commitIndex; index-- {
+        if r.termAt(index) != r.currentTerm {
+            break
+        }
+        count := 0
+        for _, member := range r.config {
+            if member == r.me || r.matchIndex[member] >= index {
+                count++
+            }
+        }
+        if count >= r.majority() {
+            r.commitIndex = index
+            r.applyCommitted()
+            break
+        }
+    }
+
+    // A leader that removed itself steps down once the removal commits
+    if r.state == Leader && !r.inConfig(r.me) && r.commitIndex >= r.lastConfigIndex() {
+        log.Println("raft: removed from the cluster, stepping down")
+        r.state = Follower
+    }
+}
+
+func (r *Raft) lastConfigIndex() int64 {
+    for i := r.lastIndex(); i > r.snapshotIndex; i-- {
+        if r.entry(i).Kind == configEntry {
+            return i
+        }
+    }
+    return r.snapshotIndex
+}
+
+func (r *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    reply.Success = false
+    if args.Term < r.currentTerm {
+        reply.Term = r.currentTerm
+        return nil
+    }
+    r.becomeFollower(args.Term)
+    reply.Term = r.currentTerm
+    r.leader = args.Leader
+    r.resetElectionDeadline()
+
+    // Everything up to the snapshot is committed, so it matches for sure
+    if args.PrevLogIndex < r.snapshotIndex {
+        skip := r.snapshotIndex - args.PrevLogIndex
+        if skip >= int64(len(args.Entries)) {
+            reply.Success = true
+            return nil
+        }
+        args.Entries = args.Entries[skip:]
+        args.PrevLogIndex = r.snapshotIndex
+        args.PrevLogTerm = r.snapshotTerm
+    }
+
+    if args.PrevLogIndex > r.lastIndex() {
+        reply.ConflictIndex = r.lastIndex() + 1
+        return nil
+    }
+    if term := r.termAt(args.PrevLogIndex); term != args.PrevLogTerm {
+        // Skip back over the whole conflicting term at once
+        conflict := args.PrevLogIndex
+        for conflict > r.snapshotIndex + 1 && r.termAt(conflict - 1) == term {
+            conflict--
+        }
+        reply.ConflictIndex = conflict
+        return nil
+    }
+
+    changed := false
+    for i, e := range args.Entries {
+        index := args.PrevLogIndex + 1 + int64(i)
+        if index <= r.lastIndex() {
+            if r.termAt(index) == e.Term {
+                continue
+            }
+            // Drop the conflicting entry and everything after it
+            r.log = r.log[:index - r.snapshotIndex - 1]
+            r.config = r.latestConfig()
+        }
+        r.appendEntry(e)
+        changed = true
+    }
+    if changed {
+        r.persist()
+    }
+
+    lastNew := args.PrevLogIndex + int64(len(args.Entries))
+    if args.LeaderCommit > r.commitIndex {
+        r.commitIndex = args.LeaderCommit
+        if lastNew < r.commitIndex {
+            r.commitIndex = lastNew
+        }
+        r.applyCommitted()
+    }
+    reply.Success = true
+    return nil
+}
+
+func (r *Raft) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if args.Term < r.currentTerm {
+        reply.Term = r.currentTerm
+        return nil
+    }
+    r.becomeFollower(args.Term)
+    reply.Term = r.currentTerm
+    r.leader = args.Leader
+    r.resetElectionDeadline()
+
+    if args.LastIncludedIndex <= r.snapshotIndex || args.LastIncludedIndex <= r.lastApplied {
+        return nil
+    }
+
+    // Keep any entries past the snapshot if our log agrees with it
+    if r.termAt(args.LastIncludedIndex) == args.LastIncludedTerm {
+        r.log = append([]Entry(nil), r.log[args.LastIncludedIndex - r.snapshotIndex:]...)
+    } else {
+        r.log = nil
+    }
+    r.snapshotIndex = args.LastIncludedIndex
+    r.snapshotTerm = args.LastIncludedTerm
+    r.snapshotConfig = args.Config
+    r.snapshotData = args.Data
+    r.config = r.latestConfig()
+    if err := r.sm.Restore(args.Data); err != nil {
+        log.Println("raft: could not restore snapshot:", err)
+        return err
+    }
+    r.lastApplied = args.LastIncludedIndex
+    if r.commitIndex < r.lastApplied {
+        r.commitIndex = r.lastApplied
+    }
+    r.persist()
+    return nil
+}
+
+/////////////// Applying ///////////////
+
+func (r *Raft) applyCommitted() {
+    for r.lastApplied < r.commitIndex {
+        r.lastApplied++
+        e := r.entry(r.lastApplied)
+        var result applyResult
+        if e.Kind == commandEntry {
+            result.value = r.sm.Apply(r.lastApplied, e.Command)
+        }
+        if w, waiting := r.waiters[r.lastApplied]; waiting {
+            if w.term != e.Term {
+                result = applyResult{nil, ErrLostLeadership}
+            }
+            w.done <- result
+            delete(r.waiters, r.lastApplied)
+        }
+    }
+    r.maybeSnapshot()
+}
+
+func (r *Raft) maybeSnapshot() {
+    if r.SnapshotThreshold <= 0 || r.lastApplied - r.snapshotIndex < int64(r.SnapshotThreshold) {
+        return
+    }
+    data, err := r.sm.Snapshot()
+    if err != nil {
+        log.Println("raft: snapshot failed:", err)
+        return
+    }
+    config := r.configAt(r.lastApplied)
+    term := r.termAt(r.lastApplied)
+    r.log = append([]Entry(nil), r.log[r.lastApplied - r.snapshotIndex:]...)
+    r.snapshotIndex = r.lastApplied
+    r.snapshotTerm = term
+    r.snapshotConfig = config
+    r.snapshotData = data
+    r.persist()
+}
+
+/////////////// Proposing ///////////////
+
+// Append an entry and wait until it is applied. Returns ErrNotLeader on
+// anything but the leader.
+func (r *Raft) propose(e Entry) (interface{}, error) {
+    r.mutex.Lock()
+    if r.state != Leader {
+        r.mutex.Unlock()
+        return nil, ErrNotLeader
+    }
+    e.Term = r.currentTerm
+    index := r.appendEntry(e)
+    r.persist()
+    done := make(chan applyResult, 1)
+    r.waiters[index] = waiter{e.Term, done}
+    r.broadcast()
+    r.mutex.Unlock()
+
+    select {
+    case result := <-done:
+        return result.value, result.err
+    case <-time.After(ProposeTimeout):
+        r.mutex.Lock()
+        delete(r.waiters, index)
+        r.mutex.Unlock()
+        return nil, ErrTimeout
+    }
+}
+
+// Replicate a command and return what the state machine's Apply returned
+// for it
+func (r *Raft) Propose(command interface{}) (interface{}, error) {
+    return r.propose(Entry{Kind: commandEntry, Command: command})
+}
+
+func (r *Raft) changeConfig(change func([]string) []string) error {
+    r.mutex.Lock()
+    if r.state != Leader {
+        r.mutex.Unlock()
+        return ErrNotLeader
+    }
+    if r.lastConfigIndex() > r.commitIndex {
+        r.mutex.Unlock()
+        return ErrConfigChangePending
+    }
+    config := change(append([]string(nil), r.config...))
+    r.mutex.Unlock()
+
+    _, err := r.propose(Entry{Kind: configEntry, Config: config})
+    return err
+}
+
+// Add a member. Only one member can be added or removed at a time.
+func (r *Raft) AddServer(addr string) error {
+    return r.changeConfig(func(config []string) []string {
+        for _, member := range config {
+            if member == addr {
+                return config
+            }
+        }
+        return append(config, addr)
+    })
+}
+
+func (r *Raft) RemoveServer(addr string) error {
+    return r.changeConfig(func(config []string) []string {
+        kept := config[:0]
+        for _, member := range config {
+            if member != addr {
+                kept = append(kept, member)
+            }
+        }
+        return kept
+    })
+}
+
+/////////////// Status ///////////////
+
+// The member we think is leader, or "" if we don't know
+func (r *Raft) Leader() string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.leader
+}
+
+func (r *Raft) IsLeader() bool {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.state == Leader
+}
+
+func (r *Raft) Status() (State, int64) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.state, r.currentTerm
+}
+
+func (r *Raft) Config() []string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return append([]string(nil), r.config...)
+}
+
+/////////////// Persistence ///////////////
+
+type persistentState struct {
+    CurrentTerm int64
+    VotedFor string
+    Log []Entry
+    SnapshotIndex int64
+    SnapshotTerm int64
+    SnapshotConfig []string
+    SnapshotData []byte
+}
+
+func (r *Raft) persist() {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(persistentState{
+        CurrentTerm: r.currentTerm,
+        VotedFor: r.votedFor,
+        Log: r.log,
+        SnapshotIndex: r.snapshotIndex,
+        SnapshotTerm: r.snapshotTerm,
+        SnapshotConfig: r.snapshotConfig,
+        SnapshotData: r.snapshotData,
+    })
+    if err == nil {
+        err = r.persister.Save(buf.Bytes())
+    }
+    if err != nil {
+        // Carrying on could break the promises we made to other members
+        log.Fatal("raft: could not persist state: ", err)
+    }
+}
+
+func (r *Raft) load() error {
+    data, err := r.persister.Load()
+    if err != nil || len(data) == 0 {
+        return err
+    }
+    var state persistentState
+    if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+        return err
+    }
+    r.currentTerm = state.CurrentTerm
+    r.votedFor = state.VotedFor
+    r.log = state.Log
+    r.snapshotIndex = state.SnapshotIndex
+    r.snapshotTerm = state.SnapshotTerm
+    r.snapshotConfig = state.SnapshotConfig
+    r.snapshotData = state.SnapshotData
+    return nil
+}
@@ -0,0 +1,353 @@
+package raft
+
+import (
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "sync"
+    "testing"
+    "time"
+)
+
+func init() {
+    log.SetOutput(ioutil.Discard)
+}
+
+var errDisconnected = errors.New("disconnected")
+
+// Delivers calls straight to the other members, unless either end is cut off
+type network struct {
+    members map[string]*Raft
+    down map[string]bool
+    mutex sync.Mutex
+}
+
+type netCaller struct {
+    n *network
+    from string
+}
+
+func (c netCaller) Call(addr string, method string, args interface{}, reply interface{}) error {
+    c.n.mutex.Lock()
+    r := c.n.members[addr]
+    cut := c.n.down[c.from] || c.n.down[addr]
+    c.n.mutex.Unlock()
+    if r == nil || cut {
+        return errDisconnected
+    }
+    switch method {
+        case "Raft.RequestVote":
+            return r.RequestVote(args.(RequestVoteArgs), reply.(*RequestVoteReply))
+        case "Raft.AppendEntries":
+            return r.AppendEntries(args.(AppendEntriesArgs), reply.(*AppendEntriesReply))
+        case "Raft.InstallSnapshot":
+            return r.InstallSnapshot(args.(InstallSnapshotArgs), reply.(*InstallSnapshotReply))
+    }
+    return fmt.Errorf("no method %s", method)
+}
+
+// Remembers every command applied, in order
+type list struct {
+    applied []int
+    mutex sync.Mutex
+}
+
+func (l *list) Apply(index int64, command interface{}) interface{} {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    l.applied = append(l.applied, command.(int))
+    return len(l.applied)
+}
+
+func (l *list) Snapshot() ([]byte, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(l.applied)
+    return buf.Bytes(), err
+}
+
+func (l *list) Restore(snapshot []byte) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    l.applied = nil
+    return gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&l.applied)
+}
+
+func (l *list) get() []int {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return append([]int(nil), l.applied...)
+}
+
+type cluster struct {
+    net *network
+    sms map[string]*list
+    persisters map[string]*MemoryPersister
+}
+
+func newCluster(t *testing.T, size int) (*cluster, []string) {
+    c := &cluster{
+        net: &network{members: make(map[string]*Raft), down: make(map[string]bool)},
+        sms: make(map[string]*list),
+        persisters: make(map[string]*MemoryPersister),
+    }
+    var addrs []string
+    for i := 0; i < size; i++ {
+        addrs = append(addrs, fmt.Sprintf("raft%d", i))
+    }
+    for _, addr := range addrs {
+        c.start(t, addr, addrs)
+    }
+    return c, addrs
+}
+
+func (c *cluster) start(t *testing.T, addr string, peers []string) *Raft {
+    if c.persisters[addr] == nil {
+        c.persisters[addr] = &MemoryPersister{}
+    }
+    c.sms[addr] = &list{}
+    r, err := New(addr, peers, c.sms[addr], c.persisters[addr])
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.Caller = netCaller{c.net, addr}
+
+    c.net.mutex.Lock()
+    if old := c.net.members[addr]; old != nil {
+        old.Stop()
+    }
+    c.net.members[addr] = r
+    c.net.mutex.Unlock()
+    r.Start()
+    return r
+}
+
+func (c *cluster) setDown(addr string, down bool) {
+    c.net.mutex.Lock()
+    defer c.net.mutex.Unlock()
+    c.net.down[addr] = down
+}
+
+func (c *cluster) stop() {
+    for _, r := range c.net.members {
+        r.Stop()
+    }
+}
+
+// Wait for exactly one reachable member to be leader
+func (c *cluster) waitLeader(t *testing.T) *Raft {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        var leaders []*Raft
+        c.net.mutex.Lock()
+        for addr, r := range c.net.members {
+            if !c.net.down[addr] && r.IsLeader() {
+                leaders = append(leaders, r)
+            }
+        }
+        c.net.mutex.Unlock()
+        if len(leaders) == 1 {
+            return leaders[0]
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    t.Fatal("no single leader was elected")
+    return nil
+}
+
+func (c *cluster) waitApplied(t *testing.T, addr string, want []int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if fmt.Sprint(c.sms[addr].get()) == fmt.Sprint(want) {
+            return
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    t.Fatalf("%s applied %v, want %v", addr, c.sms[addr].get(), want)
+}
+
+func propose(t *testing.T, r *Raft, commands ...int) {
+    for _, command := range commands {
+        if _, err := r.Propose(command); err != nil {
+            t.Fatal("propose", command, "failed:", err)
+        }
+    }
+}
+
+func TestElectsOneLeader(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+
+    leader := c.waitLeader(t)
+    time.Sleep(2 * ElectionTimeout)
+    for _, addr := range addrs {
+        if got := c.net.members[addr].Leader(); got != leader.me {
+            t.Errorf("%s thinks the leader is %q, want %q", addr, got, leader.me)
+        }
+    }
+}
+
+func TestReplicates(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+
+    leader := c.waitLeader(t)
+    result, err := leader.Propose(7)
+    if err != nil || result != 1 {
+        t.Fatal("first propose returned", result, err)
+    }
+    propose(t, leader, 8, 9)
+    for _, addr := range addrs {
+        c.waitApplied(t, addr, []int{7, 8, 9})
+    }
+
+    for _, addr := range addrs {
+        if r := c.net.members[addr]; r != leader {
+            if _, err := r.Propose(10); err != ErrNotLeader {
+                t.Error("follower accepted a proposal:", err)
+            }
+        }
+    }
+}
+
+func TestLeaderFailover(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+
+    old := c.waitLeader(t)
+    propose(t, old, 1)
+    c.setDown(old.me, true)
+
+    leader := c.waitLeader(t)
+    if leader == old {
+        t.Fatal("the cut off leader is still the only leader")
+    }
+    propose(t, leader, 2, 3)
+
+    // The old leader can't commit anything on its own
+    if _, err := old.Propose(99); err == nil {
+        t.Error("a leader without a majority committed an entry")
+    }
+
+    c.setDown(old.me, false)
+    for _, addr := range addrs {
+        c.waitApplied(t, addr, []int{1, 2, 3})
+    }
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+    for _, addr := range addrs {
+        c.net.members[addr].mutex.Lock()
+        c.net.members[addr].SnapshotThreshold = 5
+        c.net.members[addr].mutex.Unlock()
+    }
+
+    leader := c.waitLeader(t)
+    var lagging string
+    for _, addr := range addrs {
+        if addr != leader.me {
+            lagging = addr
+            break
+        }
+    }
+    c.setDown(lagging, true)
+
+    var want []int
+    for i := 0; i < 20; i++ {
+        want = append(want, i)
+    }
+    propose(t, leader, want...)
+
+    leader.mutex.Lock()
+    compacted := leader.snapshotIndex > 0
+    leader.mutex.Unlock()
+    if !compacted {
+        t.Fatal("the leader never took a snapshot")
+    }
+
+    c.setDown(lagging, false)
+    c.waitApplied(t, lagging, want)
+}
+
+func TestRestartKeepsLog(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+
+    leader := c.waitLeader(t)
+    propose(t, leader, 1, 2, 3)
+    for _, addr := range addrs {
+        c.waitApplied(t, addr, []int{1, 2, 3})
+    }
+
+    // Restart every member from what it persisted
+    for _, addr := range addrs {
+        c.start(t, addr, addrs)
+    }
+    leader = c.waitLeader(t)
+    propose(t, leader, 4)
+    for _, addr := range addrs {
+        c.waitApplied(t, addr, []int{1, 2, 3, 4})
+    }
+}
+
+func TestMembershipChange(t *testing.T) {
+    c, addrs := newCluster(t, 3)
+    defer c.stop()
+
+    leader := c.waitLeader(t)
+    propose(t, leader, 1)
+
+    // A new member starts knowing nobody and waits to be added
+    c.start(t, "raft3", nil)
+    if err := leader.AddServer("raft3"); err != nil {
+        t.Fatal("add server failed:", err)
+    }
+    propose(t, leader, 2)
+    c.waitApplied(t, "raft3", []int{1, 2})
+    if config := leader.Config(); len(config) != 4 {
+        t.Fatal("config after adding is", config)
+    }
+
+    // Remove a follower; the rest carry on without it
+    var removed string
+    for _, addr := range addrs {
+        if addr != leader.me {
+            removed = addr
+            break
+        }
+    }
+    if err := leader.RemoveServer(removed); err != nil {
+        t.Fatal("remove server failed:", err)
+    }
+    c.setDown(removed, true)
+    propose(t, leader, 3)
+    c.waitApplied(t, "raft3", []int{1, 2, 3})
+}
+
+func TestFixedPeers(t *testing.T) {
+    if _, err := NewFixed("a", []string{"b", "c"}, &list{}, &MemoryPersister{}); err != ErrNotAPeer {
+        t.Error("starting outside the peer list gave", err)
+    }
+
+    persister := &MemoryPersister{}
+    r, err := NewFixed("a", []string{"a", "b", "c"}, &list{}, persister)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.mutex.Lock()
+    r.persist()
+    r.mutex.Unlock()
+
+    if _, err := NewFixed("a", []string{"a", "b", "d"}, &list{}, persister); err != ErrPeersChanged {
+        t.Error("restarting with another peer list gave", err)
+    }
+    if _, err := NewFixed("a", []string{"c", "a", "b"}, &list{}, persister); err != nil {
+        t.Error("restarting with the peers reordered gave", err)
+    }
+}
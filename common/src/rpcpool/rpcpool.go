@@ -0,0 +1,201 @@
+// Package rpcpool keeps long-lived net/rpc clients so callers don't dial a
+// new HTTP connection for every call. A client multiplexes any number of
+// concurrent calls, so one per address is enough. Clients whose connection
+// breaks are dropped and the next call to that address dials again.
+package rpcpool
+
+import (
+    "bufio"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/rpc"
+    "sync"
+    "time"
+)
+
+// How long dialing an address may take
+const DefaultDialTimeout = 2 * time.Second
+
+// How long Call waits for an answer before it gives up on the connection
+const DefaultCallTimeout = time.Second
+
+// The pool shared by everything in the process that makes RPC calls
+var Default = New()
+
+// The answer a net/rpc HTTP server sends to CONNECT
+const connected = "200 Connected to Go RPC"
+
+type entry struct {
+    client *rpc.Client
+    // held while dialing, so calls to one address wait for a single dial
+    // without holding up calls to others
+    mutex sync.Mutex
+}
+
+type Pool struct {
+    DialTimeout time.Duration
+    CallTimeout time.Duration
+    // How connections are made; dials net/rpc's HTTP endpoint by default.
+    // Tests swap in their own.
+    Dial func(addr string, timeout time.Duration) (*rpc.Client, error)
+
+    entries map[string]*entry
+    closed bool
+    mutex sync.Mutex
+}
+
+var (
+    ErrClosed = errors.New("rpc pool is closed")
+    ErrTimeout = errors.New("rpc call timed out")
+)
+
+func New() *Pool {
+    return &Pool{DialTimeout: DefaultDialTimeout, CallTimeout: DefaultCallTimeout, Dial: DialHTTP, entries: make(map[string]*entry)}
+}
+
+// Like rpc.DialHTTP, but gives up after timeout
+func DialHTTP(addr string, timeout time.Duration) (*rpc.Client, error) {
+    conn, err := net.DialTimeout("tcp", addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(timeout))
+    io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+    resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+    if err == nil && resp.Status != connected {
+        err = errors.New("unexpected HTTP response: " + resp.Status)
+    }
+    if err != nil {
+        conn.Close()
+        return nil, &net.OpError{Op: "dial-http", Net: "tcp", Addr: nil, Err: err}
+    }
+    conn.SetDeadline(time.Time{})
+    return rpc.NewClient(conn), nil
+}
+
+// The pooled client for addr, dialing one if there is none. The client is
+// shared: hand it back with Release instead of closing it.
+func (p *Pool) Connect(addr string) (*rpc.Client, error) {
+    p.mutex.Lock()
+    if p.closed {
+        p.mutex.Unlock()
+        return nil, ErrClosed
+    }
+    e, ok := p.entries[addr]
+    if !ok {
+        e = &entry{}
+        p.entries[addr] = e
+    }
+    p.mutex.Unlock()
+
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    if e.client != nil {
+        return e.client, nil
+    }
+    client, err := p.Dial(addr, p.DialTimeout)
+    if err != nil {
+        return nil, err
+    }
+    e.client = client
+    return client, nil
+}
+
+// Whether err means the connection a call went over is no good. Errors the
+// server returned came over a working connection, and a caller giving up on
+// a slow call says nothing about the calls sharing the connection.
+func Broken(err error) bool {
+    if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+        return true
+    }
+    _, isNet := err.(net.Error)
+    return isNet
+}
+
+// Done with a client from Connect. err is what the call made with it
+// returned; if the connection broke the client is closed and dropped.
+func (p *Pool) Release(addr string, client *rpc.Client, err error) {
+    if Broken(err) {
+        p.Evict(addr, client)
+    }
+}
+
+// Close client and drop it, unless it was already replaced
+func (p *Pool) Evict(addr string, client *rpc.Client) {
+    p.mutex.Lock()
+    e, ok := p.entries[addr]
+    p.mutex.Unlock()
+    if !ok {
+        return
+    }
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    if e.client == client {
+        e.client.Close()
+        e.client = nil
+    }
+}
+
+// Call method on addr over its pooled client. A client found already shut
+// down never sent the call, so it is retried once on a new connection. A
+// peer that takes the call and does not answer within CallTimeout is taken
+// to be hung: its client is closed, failing the other calls waiting on it,
+// and the next call dials again.
+func (p *Pool) Call(addr string, method string, args interface{}, reply interface{}) error {
+    for attempt := 0; ; attempt++ {
+        client, err := p.Connect(addr)
+        if err != nil {
+            return err
+        }
+        call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+        timer := time.NewTimer(p.CallTimeout)
+        select {
+            case <-call.Done:
+                timer.Stop()
+                err = call.Error
+            case <-timer.C:
+                p.Evict(addr, client)
+                return ErrTimeout
+        }
+        p.Release(addr, client, err)
+        if err != rpc.ErrShutdown || attempt > 0 {
+            return err
+        }
+    }
+}
+
+// Close every client. Calls after this fail with ErrClosed.
+func (p *Pool) Close() {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.closed = true
+    for addr, e := range p.entries {
+        e.mutex.Lock()
+        if e.client != nil {
+            e.client.Close()
+        }
+        e.mutex.Unlock()
+        delete(p.entries, addr)
+    }
+}
+
+// How many addresses have a client open
+func (p *Pool) Len() int {
+    p.mutex.Lock()
+    entries := make([]*entry, 0, len(p.entries))
+    for _, e := range p.entries {
+        entries = append(entries, e)
+    }
+    p.mutex.Unlock()
+    n := 0
+    for _, e := range entries {
+        e.mutex.Lock()
+        if e.client != nil {
+            n++
+        }
+        e.mutex.Unlock()
+    }
+    return n
+}
@@ -0,0 +1,245 @@
+package rpcpool
+
+import (
+    "bufio"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/rpc"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type Echo struct{}
+
+func (Echo) Echo(args *int, reply *int) error {
+    *reply = *args
+    return nil
+}
+
+func (Echo) Fail(args *int, reply *int) error {
+    return errors.New("no")
+}
+
+// Answers after args milliseconds
+func (Echo) Slow(args *int, reply *int) error {
+    time.Sleep(time.Duration(*args) * time.Millisecond)
+    *reply = *args
+    return nil
+}
+
+// Counts the connections it accepts, and can drop every one of them
+type countingListener struct {
+    net.Listener
+    accepted int32
+    conns []net.Conn
+    mutex sync.Mutex
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    if err == nil {
+        atomic.AddInt32(&l.accepted, 1)
+        l.mutex.Lock()
+        l.conns = append(l.conns, conn)
+        l.mutex.Unlock()
+    }
+    return conn, err
+}
+
+func (l *countingListener) dropAll() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    for _, conn := range l.conns {
+        conn.Close()
+    }
+    l.conns = nil
+}
+
+func serve(t *testing.T) *countingListener {
+    server := rpc.NewServer()
+    server.Register(Echo{})
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    l := &countingListener{Listener: listener}
+    go http.Serve(l, server)
+    return l
+}
+
+func TestCallsShareOneConnection(t *testing.T) {
+    l := serve(t)
+    defer l.Close()
+    p := New()
+    defer p.Close()
+    addr := l.Addr().String()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            var reply int
+            if err := p.Call(addr, "Echo.Echo", &i, &reply); err != nil || reply != i {
+                t.Error("call gave", reply, err)
+            }
+        }(i)
+    }
+    wg.Wait()
+    if n := atomic.LoadInt32(&l.accepted); n != 1 {
+        t.Error("made", n, "connections")
+    }
+}
+
+func TestServerErrorsKeepTheClient(t *testing.T) {
+    l := serve(t)
+    defer l.Close()
+    p := New()
+    defer p.Close()
+    addr := l.Addr().String()
+
+    var args, reply int
+    if err := p.Call(addr, "Echo.Fail", &args, &reply); err == nil || Broken(err) {
+        t.Fatal("failing call gave", err)
+    }
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+        t.Fatal(err)
+    }
+    if n := atomic.LoadInt32(&l.accepted); n != 1 {
+        t.Error("made", n, "connections")
+    }
+}
+
+func TestTimeoutKeepsTheClient(t *testing.T) {
+    l := serve(t)
+    defer l.Close()
+    p := New()
+    defer p.Close()
+    addr := l.Addr().String()
+
+    client, err := p.Connect(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    slow, slowReply := 300, 0
+    other := client.Go("Echo.Slow", &slow, &slowReply, make(chan *rpc.Call, 1))
+    timedOut, timedOutReply := 1000, 0
+    call := client.Go("Echo.Slow", &timedOut, &timedOutReply, make(chan *rpc.Call, 1))
+    select {
+        case <-call.Done:
+            t.Fatal("slow call did not time out")
+        case <-time.After(50 * time.Millisecond):
+            p.Release(addr, client, errors.New("timed out"))
+    }
+
+    // The call still in flight and new calls carry on over the same client
+    if <-other.Done; other.Error != nil || slowReply != slow {
+        t.Error("call sharing the client gave", slowReply, other.Error)
+    }
+    args, reply := 1, 0
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+        t.Fatal(err)
+    }
+    if n := atomic.LoadInt32(&l.accepted); n != 1 {
+        t.Error("made", n, "connections")
+    }
+}
+
+// Accepts connections and then never answers a call
+func serveSilent(t *testing.T) net.Listener {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                if _, err := http.ReadRequest(reader); err != nil {
+                    return
+                }
+                io.WriteString(conn, "HTTP/1.0 " + connected + "\n\n")
+                io.Copy(ioutil.Discard, reader)
+            }()
+        }
+    }()
+    return l
+}
+
+func TestHungPeerTimesOut(t *testing.T) {
+    l := serveSilent(t)
+    defer l.Close()
+    p := New()
+    defer p.Close()
+    p.CallTimeout = 100 * time.Millisecond
+    addr := l.Addr().String()
+
+    args, reply := 1, 0
+    start := time.Now()
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err != ErrTimeout {
+        t.Fatal("call to a hung peer gave", err)
+    }
+    if waited := time.Since(start); waited > time.Second {
+        t.Error("call took", waited)
+    }
+    // The hung connection is dropped, so the next call dials again
+    if n := p.Len(); n != 0 {
+        t.Error(n, "clients still open")
+    }
+}
+
+func TestReconnectsAfterConnectionDrops(t *testing.T) {
+    l := serve(t)
+    defer l.Close()
+    p := New()
+    defer p.Close()
+    addr := l.Addr().String()
+
+    args, reply := 1, 0
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+        t.Fatal(err)
+    }
+    l.dropAll()
+
+    // A call may be sent before the client notices, but that drops it, so
+    // the next one is on a new connection
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+        if !Broken(err) {
+            t.Fatal("call over a dropped connection gave", err)
+        }
+        if err = p.Call(addr, "Echo.Echo", &args, &reply); err != nil {
+            t.Fatal("call after the drop gave", err)
+        }
+    }
+    if n := atomic.LoadInt32(&l.accepted); n != 2 {
+        t.Error("made", n, "connections")
+    }
+    if p.Len() != 1 {
+        t.Error("pool has", p.Len(), "clients")
+    }
+}
+
+func TestUnreachableAddress(t *testing.T) {
+    l := serve(t)
+    addr := l.Addr().String()
+    l.Close()
+    p := New()
+    defer p.Close()
+    var args, reply int
+    if err := p.Call(addr, "Echo.Echo", &args, &reply); err == nil {
+        t.Fatal("call to a closed port worked")
+    }
+    if p.Len() != 0 {
+        t.Error("pool kept a client for a closed port")
+    }
+}
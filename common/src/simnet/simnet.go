@@ -0,0 +1,295 @@
+// Package simnet runs many membertables on a simulated network and clock so
+// failure detection can be tested deterministically. Everything happens on
+// the calling goroutine and all randomness comes from the seed given to New,
+// so a run can be reproduced exactly.
+package simnet
+
+import (
+    "container/heap"
+    "errors"
+    "math/rand"
+    "time"
+
+    "membertable"
+)
+
+var (
+    ErrUnreachable = errors.New("address unreachable")
+)
+
+type event struct {
+    at membertable.Timestamp
+    seq int64
+    fn func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+    if q[i].at != q[j].at {
+        return q[i].at < q[j].at
+    }
+    return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+    old := *q
+    e := old[len(old) - 1]
+    *q = old[:len(old) - 1]
+    return e
+}
+
+type Node struct {
+    Table *membertable.Table
+    Up bool
+
+    // bumped on every crash so ticks scheduled before it are ignored
+    generation int
+}
+
+type Network struct {
+    // Fraction of heartbeats and pings that are silently dropped
+    Loss float64
+    // Every message takes between MinDelay and MaxDelay to arrive
+    MinDelay time.Duration
+    MaxDelay time.Duration
+    // If set, called with every heartbeat, sync and ping a node sends, before
+    // it can be lost
+    Sent func(from, to, kind string, members []membertable.Member)
+
+    now membertable.Timestamp
+    seq int64
+    rand *rand.Rand
+    events eventQueue
+    nodes map[string]*Node
+    // nodes in different groups cannot reach each other; unlisted nodes are in
+    // group 0, and nil means no partition
+    groups map[string]int
+    // clocks that don't agree with the network's, by address
+    clocks map[string]*skewedClock
+}
+
+func New(seed int64) *Network {
+    return &Network{
+        MinDelay: time.Millisecond,
+        MaxDelay: 5 * time.Millisecond,
+        rand: rand.New(rand.NewSource(seed)),
+        nodes: make(map[string]*Node),
+        clocks: make(map[string]*skewedClock),
+    }
+}
+
+// The current simulated time
+func (n *Network) Now() membertable.Timestamp {
+    return n.now
+}
+
+func (n *Network) Node(addr string) *Node {
+    return n.nodes[addr]
+}
+
+func (n *Network) schedule(after time.Duration, fn func()) {
+    n.seq++
+    heap.Push(&n.events, &event{n.now + membertable.Timestamp(after), n.seq, fn})
+}
+
+// A node's own clock: offset from the network's and running at rate times
+// its speed
+type skewedClock struct {
+    n *Network
+    offset time.Duration
+    rate float64
+}
+
+func (c *skewedClock) Now() membertable.Timestamp {
+    return membertable.Timestamp(c.offset) + membertable.Timestamp(float64(c.n.now) * c.rate)
+}
+
+// Give the node that will be added at addr a clock that is off by offset and
+// runs rate times as fast as everyone else's. Must be called before AddNode.
+func (n *Network) Skew(addr string, offset time.Duration, rate float64) {
+    n.clocks[addr] = &skewedClock{n, offset, rate}
+}
+
+// Create a node with the given ID and start it heartbeating
+func (n *Network) AddNode(id membertable.ID) *membertable.Table {
+    return n.startNode(id, 0)
+}
+
+func (n *Network) startNode(id membertable.ID, incarnation int64) *membertable.Table {
+    var t membertable.Table
+    t.Transport = &transport{n, id.Address}
+    t.Clock = n
+    if clock, skewed := n.clocks[id.Address]; skewed {
+        t.Clock = clock
+    }
+    t.Rand = rand.New(rand.NewSource(n.rand.Int63()))
+    t.InitIncarnation(id, incarnation)
+
+    node, exists := n.nodes[id.Address]
+    if !exists {
+        node = &Node{}
+        n.nodes[id.Address] = node
+    }
+    node.Table = &t
+    node.Up = true
+    node.generation++
+
+    // Spread the ticks out so the nodes don't all heartbeat in lockstep
+    n.scheduleTick(node, time.Duration(n.rand.Int63n(int64(membertable.HeartbeatInterval))))
+    return &t
+}
+
+func (n *Network) scheduleTick(node *Node, after time.Duration) {
+    generation := node.generation
+    n.schedule(after, func() {
+        if !node.Up || node.generation != generation {
+            return
+        }
+        node.Table.Tick()
+        n.scheduleTick(node, membertable.HeartbeatInterval)
+    })
+}
+
+// Start a crashed node over from scratch under its old ID and the next
+// incarnation, like a restarted process would
+func (n *Network) Reboot(addr string) *membertable.Table {
+    old := n.nodes[addr].Table
+    me := old.Members[old.MyID()]
+    return n.startNode(me.ID, me.Incarnation + 1)
+}
+
+// Have the node at addr send its table to seedAddr, like a node starting with
+// -seed would
+func (n *Network) Join(addr, seedAddr string) error {
+    return n.nodes[addr].Table.SendHeartbeatToAddress(seedAddr)
+}
+
+// Stop a node; it neither sends nor receives until restarted
+func (n *Network) Crash(addr string) {
+    node := n.nodes[addr]
+    node.Up = false
+    node.generation++
+}
+
+// Bring a crashed node back with the table it had when it crashed
+func (n *Network) Restart(addr string) {
+    node := n.nodes[addr]
+    if node.Up {
+        return
+    }
+    node.Up = true
+    n.scheduleTick(node, membertable.HeartbeatInterval)
+}
+
+// Split the network so only nodes within the same group can talk. Nodes not
+// listed in any group, including ones added later, all end up together in
+// one more group, so listing a single group cuts it off from the rest.
+func (n *Network) Partition(groups ...[]string) {
+    n.groups = make(map[string]int)
+    for i, group := range groups {
+        for _, addr := range group {
+            n.groups[addr] = i + 1
+        }
+    }
+}
+
+func (n *Network) Heal() {
+    n.groups = nil
+}
+
+func (n *Network) reachable(from, to string) bool {
+    node, exists := n.nodes[to]
+    if !exists || !node.Up || !n.nodes[from].Up {
+        return false
+    }
+    return n.groups == nil || n.groups[from] == n.groups[to]
+}
+
+func (n *Network) delay() time.Duration {
+    spread := int64(n.MaxDelay - n.MinDelay)
+    if spread <= 0 {
+        return n.MinDelay
+    }
+    return n.MinDelay + time.Duration(n.rand.Int63n(spread + 1))
+}
+
+// Run the simulation forward by d
+func (n *Network) Run(d time.Duration) {
+    end := n.now + membertable.Timestamp(d)
+    for len(n.events) > 0 && n.events[0].at <= end {
+        e := heap.Pop(&n.events).(*event)
+        n.now = e.at
+        e.fn()
+    }
+    n.now = end
+}
+
+type transport struct {
+    n *Network
+    from string
+}
+
+func copyMembers(members []membertable.Member) []membertable.Member {
+    return append([]membertable.Member(nil), members...)
+}
+
+func (t *transport) sent(to, kind string, members []membertable.Member) {
+    if t.n.Sent != nil {
+        t.n.Sent(t.from, to, kind, copyMembers(members))
+    }
+}
+
+func (t *transport) deliver(to string, fn func(*membertable.Table)) {
+    t.n.schedule(t.n.delay(), func() {
+        // The network may have changed while the message was in flight
+        if t.n.reachable(t.from, to) {
+            fn(t.n.nodes[to].Table)
+        }
+    })
+}
+
+func (t *transport) Heartbeat(addr string, members []membertable.Member) error {
+    t.sent(addr, "heartbeat", members)
+    if !t.n.reachable(t.from, addr) || t.n.rand.Float64() < t.n.Loss {
+        return nil
+    }
+    members = copyMembers(members)
+    t.deliver(addr, func(table *membertable.Table) {
+        table.Receive(members)
+    })
+    return nil
+}
+
+// Syncs model a TCP connection, so they are never lost but fail outright if
+// the other end can't be reached
+func (t *transport) Sync(addr string, members []membertable.Member) error {
+    t.sent(addr, "sync", members)
+    if !t.n.reachable(t.from, addr) {
+        return ErrUnreachable
+    }
+    members = copyMembers(members)
+    t.deliver(addr, func(table *membertable.Table) {
+        table.Receive(members)
+    })
+    return nil
+}
+
+func (t *transport) Ping(addr string, me membertable.Member) error {
+    t.sent(addr, "ping", []membertable.Member{me})
+    if !t.n.reachable(t.from, addr) || t.n.rand.Float64() < t.n.Loss {
+        return nil
+    }
+    from := t.from
+    t.deliver(addr, func(table *membertable.Table) {
+        ack := table.ReceivePing([]membertable.Member{me})
+        table.Transport.Heartbeat(from, []membertable.Member{ack})
+    })
+    return nil
+}
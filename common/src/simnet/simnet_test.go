@@ -0,0 +1,381 @@
+package simnet
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "strings"
+    "testing"
+    "time"
+
+    "membertable"
+)
+
+func init() {
+    log.SetOutput(ioutil.Discard)
+}
+
+func addr(i int) string {
+    return fmt.Sprintf("10.0.%v.%v:7777", i / 256, i % 256)
+}
+
+// Start size nodes and have all of them join through the first one
+func startCluster(seed int64, size int) *Network {
+    n := New(seed)
+    for i := 0; i < size; i++ {
+        n.AddNode(membertable.ID{Num: membertable.IDNum(i), Name: "node", Address: addr(i)})
+        if i > 0 {
+            n.Join(addr(i), addr(0))
+        }
+    }
+    return n
+}
+
+func TestClusterConverges(t *testing.T) {
+    n := startCluster(1, 100)
+    n.Run(10 * time.Second)
+    for i := 0; i < 100; i++ {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != 100 {
+            t.Errorf("node %v sees %v of 100 members", i, active)
+        }
+    }
+}
+
+func TestNoFalsePositivesUnderLoss(t *testing.T) {
+    n := startCluster(2, 50)
+    n.Loss = 0.3
+    n.MaxDelay = 50 * time.Millisecond
+
+    failures := 0
+    for i := 0; i < 50; i++ {
+        n.Node(addr(i)).Table.Changed = func(t *membertable.Table, ids []membertable.ID, dropped bool) {
+            if dropped {
+                failures += len(ids)
+            }
+        }
+    }
+    n.Run(20 * time.Second)
+    if failures != 0 {
+        t.Errorf("%v members were wrongly marked failed", failures)
+    }
+}
+
+func TestCrashDetected(t *testing.T) {
+    n := startCluster(3, 20)
+    n.Run(5 * time.Second)
+    n.Crash(addr(7))
+    n.Run(time.Duration(membertable.TFail) + time.Second)
+
+    crashed := membertable.ID{Num: 7, Name: "node", Address: addr(7)}
+    for i := 0; i < 20; i++ {
+        if i != 7 && !n.Node(addr(i)).Table.IsDead(crashed) {
+            t.Errorf("node %v did not notice the crash", i)
+        }
+    }
+}
+
+func TestMetrics(t *testing.T) {
+    n := startCluster(3, 20)
+    n.Run(5 * time.Second)
+    n.Crash(addr(7))
+    n.Run(time.Duration(membertable.TFail) + time.Second)
+
+    var buf bytes.Buffer
+    n.Node(addr(0)).Table.WriteMetrics(&buf)
+    metrics := buf.String()
+    for _, want := range []string{
+        "membertable_failures_detected_total 1\n",
+        "membertable_false_positives_total 0\n",
+        "membertable_members{state=\"alive\"} 19\n",
+        "membertable_members{state=\"failed\"} 1\n",
+        "membertable_heartbeat_gap_seconds_count ",
+        "membertable_detection_latency_seconds_count 1\n",
+    } {
+        if !strings.Contains(metrics, want) {
+            t.Errorf("metrics are missing %q:\n%s", want, metrics)
+        }
+    }
+}
+
+// Members that never heartbeat, so nothing about them changes once they are
+// known
+func ghosts(count int) []membertable.Member {
+    members := make([]membertable.Member, count)
+    for i := range members {
+        members[i] = membertable.Member{ID: membertable.ID{Num: membertable.IDNum(100 + i), Name: "ghost", Address: addr(100 + i)}, HeartbeatID: 1}
+    }
+    return members
+}
+
+func TestUpdatePiggybackedLimitedTimes(t *testing.T) {
+    n := startCluster(7, 4)
+    n.Run(time.Second)
+    ghost := ghosts(1)[0]
+    piggybacked := 0
+    n.Sent = func(from, to, kind string, members []membertable.Member) {
+        if from != addr(1) || kind != "heartbeat" {
+            return
+        }
+        for _, mem := range members {
+            if mem.ID == ghost.ID {
+                piggybacked++
+            }
+        }
+    }
+    n.Node(addr(1)).Table.Receive([]membertable.Member{ghost})
+    n.Run(time.Duration(membertable.TFail) / 2)
+
+    // With the ghost there are 5 members, and log2(5) rounds to 2
+    if want := membertable.RetransmitMult * (1 + 2); piggybacked != want {
+        t.Errorf("new member piggybacked %v times, want %v", piggybacked, want)
+    }
+}
+
+func TestPiggybackIsCapped(t *testing.T) {
+    n := startCluster(8, 4)
+    n.Run(time.Second)
+    news := ghosts(2 * membertable.MaxPiggyback)
+    largest := 0
+    seen := make(map[membertable.ID]bool)
+    n.Sent = func(from, to, kind string, members []membertable.Member) {
+        if from != addr(1) || kind != "heartbeat" {
+            return
+        }
+        if len(members) > largest {
+            largest = len(members)
+        }
+        for _, mem := range members {
+            seen[mem.ID] = true
+        }
+    }
+    n.Node(addr(1)).Table.Receive(news)
+    n.Run(time.Duration(membertable.TFail) / 2)
+
+    // Our own entry goes along with the capped queue
+    if largest != membertable.MaxPiggyback + 1 {
+        t.Errorf("largest heartbeat had %v entries", largest)
+    }
+    // and what doesn't fit goes on the following heartbeats
+    for _, ghost := range news {
+        if !seen[ghost.ID] {
+            t.Errorf("%v was never piggybacked", ghost.ID)
+        }
+    }
+}
+
+func TestFullSyncInterval(t *testing.T) {
+    n := startCluster(9, 4)
+    n.Run(time.Second)
+    var kinds []string
+    n.Sent = func(from, to, kind string, members []membertable.Member) {
+        if from == addr(1) {
+            kinds = append(kinds, kind)
+        }
+    }
+    n.Run(10 * time.Second)
+
+    syncs, last := 0, -1
+    for i, kind := range kinds {
+        if kind != "sync" {
+            continue
+        }
+        if last >= 0 && i - last != membertable.FullSyncInterval {
+            t.Errorf("full syncs %v messages apart", i - last)
+        }
+        syncs++
+        last = i
+    }
+    if ticks := int(10 * time.Second / membertable.HeartbeatInterval); syncs != ticks / membertable.FullSyncInterval {
+        t.Errorf("%v full syncs in %v heartbeats", syncs, ticks)
+    }
+}
+
+func TestSkewedClocks(t *testing.T) {
+    n := New(11)
+    for i := 0; i < 20; i++ {
+        // Clocks hours apart in both directions, running up to 10% fast or slow
+        n.Skew(addr(i), time.Duration(i - 10) * time.Hour, 0.9 + float64(i) / 100)
+        n.AddNode(membertable.ID{Num: membertable.IDNum(i), Name: "node", Address: addr(i)})
+        if i > 0 {
+            n.Join(addr(i), addr(0))
+        }
+    }
+    n.Run(10 * time.Second)
+
+    for i := 0; i < 20; i++ {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != 20 {
+            t.Errorf("node %v sees %v active members, want 20", i, active)
+        }
+    }
+
+    // The node with the clock furthest ahead still gets detected
+    n.Crash(addr(19))
+    n.Run(time.Duration(membertable.TFail) * 10 / 9 + time.Second)
+    crashed := membertable.ID{Num: 19, Name: "node", Address: addr(19)}
+    for i := 0; i < 19; i++ {
+        if !n.Node(addr(i)).Table.IsDead(crashed) {
+            t.Errorf("node %v did not notice the crash", i)
+        }
+    }
+}
+
+func TestSeedList(t *testing.T) {
+    n := startCluster(6, 5)
+
+    // The first seed doesn't exist; the second one does
+    late := n.AddNode(membertable.ID{Num: 10, Name: "node", Address: addr(10)})
+    late.Seeds = []string{addr(99), addr(3)}
+
+    // This one's only seed isn't up yet
+    early := n.AddNode(membertable.ID{Num: 11, Name: "node", Address: addr(11)})
+    early.Seeds = []string{addr(12)}
+    n.Run(3 * time.Second)
+    if active := len(early.ActiveMembers()); active != 1 {
+        t.Fatalf("node 11 sees %v members before its seed is up", active)
+    }
+
+    n.AddNode(membertable.ID{Num: 12, Name: "node", Address: addr(12)})
+    n.Join(addr(12), addr(0))
+    n.Run(10 * time.Second)
+
+    for _, i := range []int{0, 10, 11, 12} {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != 8 {
+            t.Errorf("node %v sees %v active members, want 8", i, active)
+        }
+    }
+}
+
+func TestWholeClusterRestart(t *testing.T) {
+    n := startCluster(8, 10)
+    n.Run(5 * time.Second)
+
+    snapshots := make([]bytes.Buffer, 10)
+    for i := 0; i < 10; i++ {
+        n.Node(addr(i)).Table.WriteTo(&snapshots[i])
+        n.Crash(addr(i))
+    }
+    n.Run(time.Second)
+
+    // Nobody joins through a seed; they only have what they knew before
+    for i := 0; i < 10; i++ {
+        table := n.Reboot(addr(i))
+        if err := table.ReadSnapshot(&snapshots[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    n.Run(5 * time.Second)
+
+    for i := 0; i < 10; i++ {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != 10 {
+            t.Errorf("node %v sees %v active members after restarting, want 10", i, active)
+        }
+    }
+}
+
+func TestPartition(t *testing.T) {
+    n := startCluster(4, 40)
+    n.Run(5 * time.Second)
+
+    var left, right []string
+    for i := 0; i < 40; i++ {
+        if i < 15 {
+            left = append(left, addr(i))
+        } else {
+            right = append(right, addr(i))
+        }
+    }
+    n.Partition(left, right)
+    n.Run(time.Duration(membertable.TDrop))
+
+    for i := 0; i < 40; i++ {
+        expected := 25
+        if i < 15 {
+            expected = 15
+        }
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != expected {
+            t.Errorf("node %v sees %v members, expected %v", i, active, expected)
+        }
+        if minority := n.Node(addr(i)).Table.InMinority(); minority != (i < 15) {
+            t.Errorf("node %v got minority=%v", i, minority)
+        }
+    }
+}
+
+func TestUnlistedNodesStayTogether(t *testing.T) {
+    n := startCluster(10, 6)
+    n.Run(3 * time.Second)
+    n.Partition([]string{addr(0), addr(1)}, []string{addr(2)})
+    n.Run(time.Duration(membertable.TDrop))
+
+    for i, expected := range []int{2, 2, 1, 3, 3, 3} {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != expected {
+            t.Errorf("node %v sees %v members, expected %v", i, active, expected)
+        }
+    }
+}
+
+func TestRebootRejoins(t *testing.T) {
+    n := startCluster(6, 20)
+    n.Run(3 * time.Second)
+    n.Crash(addr(5))
+    n.Run(time.Duration(membertable.TFail) + time.Second)
+
+    n.Reboot(addr(5))
+    n.Join(addr(5), addr(0))
+    n.Run(3 * time.Second)
+
+    rebooted := membertable.ID{Num: 5, Name: "node", Address: addr(5)}
+    for i := 0; i < 20; i++ {
+        table := n.Node(addr(i)).Table
+        if table.IsDead(rebooted) {
+            t.Errorf("node %v still thinks the rebooted node is dead", i)
+        } else if table.Members[rebooted].Incarnation != 1 {
+            t.Errorf("node %v has incarnation %v", i, table.Members[rebooted].Incarnation)
+        }
+    }
+}
+
+func TestPartitionHeals(t *testing.T) {
+    n := startCluster(7, 20)
+    n.Run(3 * time.Second)
+    n.Partition([]string{addr(0), addr(1), addr(2)})
+    n.Run(time.Duration(membertable.TFail) + time.Second)
+    n.Heal()
+    n.Run(3 * time.Second)
+
+    for i := 0; i < 20; i++ {
+        if active := len(n.Node(addr(i)).Table.ActiveMembers()); active != 20 {
+            t.Errorf("node %v sees %v of 20 members after healing", i, active)
+        }
+    }
+}
+
+// Record every membership change so two runs can be compared
+func trace(seed int64) []string {
+    n := startCluster(seed, 30)
+    n.Loss = 0.2
+    var events []string
+    for i := 0; i < 30; i++ {
+        i := i
+        n.Node(addr(i)).Table.Changed = func(t *membertable.Table, ids []membertable.ID, dropped bool) {
+            events = append(events, fmt.Sprint(n.Now(), i, ids, dropped))
+        }
+    }
+    n.Run(3 * time.Second)
+    n.Crash(addr(3))
+    n.Partition([]string{addr(10), addr(11), addr(12)})
+    n.Run(5 * time.Second)
+    return events
+}
+
+func TestReproducible(t *testing.T) {
+    first := trace(5)
+    second := trace(5)
+    if len(first) == 0 {
+        t.Fatal("nothing happened")
+    }
+    if fmt.Sprint(first) != fmt.Sprint(second) {
+        t.Error("the same seed gave two different runs")
+    }
+}
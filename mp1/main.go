@@ -13,6 +13,7 @@ import (
 var listenAddress = flag.String("bind", ":7777", "the address for listening for log queries")
 var hostsList = flag.String("machines", "127.0.0.1:7777", "comma seperated list of addresses of other hosts with logs")
 var batch = flag.Bool("batch", false, "set to true to disable the prompt (but still listen for queries")
+var membersAddress = flag.String("members", "", "the address of a membership node; if given, queries go to every live member with the grep role instead of -machines")
 var logFile = flag.String("logs", "machine.log", "set to true to disable the prompt but still listen for queries")
 
 func runListener(quit chan int) {
@@ -63,7 +64,6 @@ func runPrompt(quit chan int) {
         return
     }
 
-    hosts := strings.Split(*hostsList, ",")
     promptReader := bufio.NewReader(os.Stdin)
     for {
         fmt.Print("> ")
@@ -81,6 +81,17 @@ func runPrompt(quit chan int) {
 
         queryStartTime := time.Now()
 
+        // Membership can change between queries, so ask every time
+        hosts := strings.Split(*hostsList, ",")
+        if *membersAddress != "" {
+            _, port, _ := net.SplitHostPort(*listenAddress)
+            var err error
+            if hosts, err = grepHostsFrom(*membersAddress, port); err != nil {
+                fmt.Println("failed to get members: ", err)
+                continue
+            }
+        }
+
         requestOutput := make(chan *HostLog)
         aliveRequests := 0
         for _,host := range hosts {
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "net"
+    "net/rpc"
+)
+
+// The role and tag membership nodes use for machines that answer log queries
+const grepRole = "grep"
+const grepAddressTag = "grep.address"
+
+// The parts of a membertable.Member we need. Gob matches fields by name, so
+// these decode straight from the membership RPC.
+type memberID struct {
+    Address string
+}
+
+type memberMeta struct {
+    Tags map[string]string
+}
+
+type member struct {
+    ID memberID
+    Meta memberMeta
+}
+
+// Ask the membership node at membersAddr for every live member with the grep
+// role and return where to send them queries. A member without a grep.address
+// tag is assumed to listen on the same port we do.
+func grepHostsFrom(membersAddr string, defaultPort string) ([]string, error) {
+    client, err := rpc.DialHTTP("tcp", membersAddr)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+
+    var members []member
+    if err = client.Call("Table.RPCGetActiveMembersWithRole", grepRole, &members); err != nil {
+        return nil, err
+    }
+
+    hosts := make([]string, 0, len(members))
+    for _, m := range members {
+        addr := m.Meta.Tags[grepAddressTag]
+        if addr == "" {
+            host, _, err := net.SplitHostPort(m.ID.Address)
+            if err != nil {
+                continue
+            }
+            addr = net.JoinHostPort(host, defaultPort)
+        }
+        hosts = append(hosts, addr)
+    }
+    return hosts, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "net/rpc"
+    "reflect"
+    "testing"
+)
+
+// Stands in for a membertable.Table
+type Table struct {
+    members []member
+}
+
+func (t *Table) RPCGetActiveMembersWithRole(role string, members *[]member) error {
+    *members = t.members
+    return nil
+}
+
+func TestGrepHostsFrom(t *testing.T) {
+    server := rpc.NewServer()
+    server.Register(&Table{[]member{
+        {memberID{"10.0.0.1:5000"}, memberMeta{map[string]string{"roles": "grep"}}},
+        {memberID{"10.0.0.2:5000"}, memberMeta{map[string]string{grepAddressTag: "10.0.0.2:9999"}}},
+    }})
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go http.Serve(ln, server)
+
+    hosts, err := grepHostsFrom(ln.Addr().String(), "7777")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []string{"10.0.0.1:7777", "10.0.0.2:9999"}
+    if !reflect.DeepEqual(hosts, want) {
+        t.Errorf("hosts are %v, want %v", hosts, want)
+    }
+}
@@ -0,0 +1,133 @@
+// Package election picks a leader from the members of a membertable.
+//
+// It is a bully election that runs on the membership view instead of its own
+// messages: the live member with the highest ID is the leader. Since the
+// tables converge through gossip, every member ends up with the same leader,
+// and when the leader fails or a higher member joins, everyone moves on as
+// soon as their table notices.
+package election
+
+import (
+    "log"
+    "sync"
+    "time"
+
+    "membertable"
+)
+
+// How often the membership table is checked for a new leader
+const CheckInterval = 100 * time.Millisecond
+
+// How many leadership changes are buffered for a slow reader before the
+// oldest get thrown away
+const eventBuffer = 16
+
+type Change struct {
+    Leader membertable.ID
+    // goes up by one every time the leader changes on this member
+    Term int64
+    // true if this member is the new leader
+    IsMe bool
+}
+
+type Election struct {
+    table *membertable.Table
+    me membertable.ID
+
+    leader membertable.ID
+    hasLeader bool
+    term int64
+    listeners []chan Change
+    mutex sync.Mutex
+}
+
+func New(t *membertable.Table, me membertable.ID) *Election {
+    return &Election{table: t, me: me}
+}
+
+func idLess(a, b membertable.ID) bool {
+    if a.Num != b.Num {
+        return a.Num < b.Num
+    }
+    if a.Address != b.Address {
+        return a.Address < b.Address
+    }
+    return a.Name < b.Name
+}
+
+func (e *Election) CurrentLeader() (membertable.ID, bool) {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    return e.leader, e.hasLeader
+}
+
+func (e *Election) IsLeader() bool {
+    leader, ok := e.CurrentLeader()
+    return ok && leader == e.me
+}
+
+func (e *Election) Term() int64 {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    return e.term
+}
+
+// A channel that gets every leadership change from now on
+func (e *Election) Events() <-chan Change {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    c := make(chan Change, eventBuffer)
+    e.listeners = append(e.listeners, c)
+    return c
+}
+
+// Look at the membership table and announce a new leader if it changed
+func (e *Election) Check() {
+    var best membertable.ID
+    found := false
+    for _, mem := range e.table.ActiveMembers() {
+        if !found || idLess(best, mem.ID) {
+            best = mem.ID
+            found = true
+        }
+    }
+
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    if !found || (e.hasLeader && best == e.leader) {
+        return
+    }
+    e.leader = best
+    e.hasLeader = true
+    e.term++
+    log.Println("leader is now", best, "for term", e.term)
+
+    change := Change{best, e.term, best == e.me}
+    for _, c := range e.listeners {
+        select {
+        case c <- change:
+        default:
+            // Make room by dropping the oldest change
+            select {
+            case <-c:
+            default:
+            }
+            select {
+            case c <- change:
+            default:
+            }
+        }
+    }
+}
+
+func (e *Election) Run() {
+    for {
+        e.Check()
+        time.Sleep(CheckInterval)
+    }
+}
+
+func (e *Election) RPCCurrentLeader(dummy int, leader *membertable.ID) error {
+    *leader, _ = e.CurrentLeader()
+    return nil
+}
@@ -0,0 +1,40 @@
+package election
+
+import (
+    "testing"
+
+    "membertable"
+)
+
+func TestHighestMemberLeads(t *testing.T) {
+    me := membertable.ID{Num: 2, Name: "b", Address: "1.1.1.2"}
+    var table membertable.Table
+    table.Init(me)
+
+    e := New(&table, me)
+    events := e.Events()
+    e.Check()
+    if !e.IsLeader() {
+        t.Error("alone but not the leader")
+    }
+
+    higher := membertable.ID{Num: 5, Name: "e", Address: "1.1.1.5"}
+    table.MergeMember(membertable.Member{ID: membertable.ID{Num: 1, Name: "a", Address: "1.1.1.1"}})
+    table.MergeMember(membertable.Member{ID: higher})
+    e.Check()
+    if leader, _ := e.CurrentLeader(); leader != higher || e.IsLeader() {
+        t.Error("wrong leader", leader)
+    }
+
+    first := <-events
+    second := <-events
+    if !first.IsMe || second.IsMe || second.Leader != higher || second.Term != first.Term + 1 {
+        t.Error("wrong events", first, second)
+    }
+
+    // Nothing changed, so no new term
+    e.Check()
+    if e.Term() != 2 {
+        t.Error("term moved without a new leader")
+    }
+}
@@ -0,0 +1,281 @@
+package leader
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io/ioutil"
+    "log"
+    "net/rpc"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "membertable"
+)
+
+// How many IDs past the current request get reserved at once, so that not
+// every request needs a disk write and a round to the replicas
+const reserveSize = membertable.IDNum(64)
+
+var (
+    ErrNoQuorum = errors.New("could not reach a majority of id replicas")
+)
+
+// A range of IDs [Start, End) handed to a single client
+type Block struct {
+    Start membertable.IDNum
+    End membertable.IDNum
+}
+
+// Hands out IDs that are never handed out again, even across crashes and
+// even if several allocators are active at once.
+//
+// Every allocator is also a replica of the counter for its peers. The counter
+// only ever moves forward by compare-and-set on a majority of the replicas,
+// so each range [old, new) is owned by exactly one allocator. Anything below
+// the counter is assumed to have been handed out already.
+type Allocator struct {
+    // Addresses of the other replicas (their RPC servers)
+    Peers []string
+
+    filename string
+    // the counter this replica has stored
+    stored membertable.IDNum
+    storeMutex sync.Mutex
+
+    // the range this allocator owns and has not handed out yet. Kept under
+    // its own lock, since leasing waits on peers that may be leasing too.
+    next membertable.IDNum
+    limit membertable.IDNum
+    leaseMutex sync.Mutex
+}
+
+// Load the counter stored in the given file. A missing file counts as zero.
+func NewAllocator(filename string) (*Allocator, error) {
+    a := &Allocator{filename: filename}
+    data, err := ioutil.ReadFile(filename)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if len(data) > 0 {
+        if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &a.stored); err != nil {
+            return nil, err
+        }
+    }
+    return a, nil
+}
+
+// Write the counter to a temporary file, flush it and rename it over the old
+// file, so a crash leaves either the old or the new counter but never neither
+func writeCounter(filename string, value membertable.IDNum) error {
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.BigEndian, value)
+
+    tmpName := filename + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+    if _, err = f.Write(buf.Bytes()); err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        return err
+    }
+    if err = os.Rename(tmpName, filename); err != nil {
+        return err
+    }
+
+    // Make the rename itself durable
+    dir, err := os.Open(filepath.Dir(filename))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return dir.Sync()
+}
+
+type CASArgs struct {
+    Old membertable.IDNum
+    New membertable.IDNum
+}
+
+// Move this replica's counter from args.Old (or anything below it, if this
+// replica missed some moves) to args.New. Replies whether it moved.
+func (a *Allocator) RPCCompareAndSet(args CASArgs, accepted *bool) error {
+    return a.compareAndSet(args, accepted)
+}
+
+func (a *Allocator) compareAndSet(args CASArgs, accepted *bool) error {
+    a.storeMutex.Lock()
+    defer a.storeMutex.Unlock()
+    *accepted = false
+    if a.stored <= args.Old && args.New > args.Old {
+        if err := writeCounter(a.filename, args.New); err != nil {
+            return err
+        }
+        a.stored = args.New
+        *accepted = true
+    }
+    return nil
+}
+
+func (a *Allocator) RPCGetCounter(dummy int, current *membertable.IDNum) error {
+    a.storeMutex.Lock()
+    defer a.storeMutex.Unlock()
+    *current = a.stored
+    return nil
+}
+
+func (a *Allocator) majority() int {
+    return (len(a.Peers) + 1) / 2 + 1
+}
+
+func callPeer(addr string, method string, args interface{}, reply interface{}) error {
+    client, err := rpc.DialHTTP("tcp", addr)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    return client.Call(method, args, reply)
+}
+
+// The highest counter stored on a majority of replicas. Since every counter
+// move reached a majority, this is at least as high as any of them.
+func (a *Allocator) readCounter() (membertable.IDNum, error) {
+    var highest membertable.IDNum
+    a.RPCGetCounter(0, &highest)
+    replies := 1
+    for _, peer := range a.Peers {
+        var current membertable.IDNum
+        if err := callPeer(peer, "Allocator.RPCGetCounter", 0, &current); err != nil {
+            log.Println("id replica", peer, "unreachable:", err)
+            continue
+        }
+        replies++
+        if current > highest {
+            highest = current
+        }
+    }
+    if replies < a.majority() {
+        return 0, ErrNoQuorum
+    }
+    return highest, nil
+}
+
+// Try to move the counter from old to new on a majority of replicas
+func (a *Allocator) advanceCounter(old, new membertable.IDNum) (bool, error) {
+    args := CASArgs{old, new}
+    accepted := 0
+
+    var ok bool
+    if err := a.compareAndSet(args, &ok); err != nil {
+        return false, err
+    }
+    if ok {
+        accepted++
+    }
+    for _, peer := range a.Peers {
+        if err := callPeer(peer, "Allocator.RPCCompareAndSet", args, &ok); err != nil {
+            log.Println("id replica", peer, "unreachable:", err)
+            continue
+        }
+        if ok {
+            accepted++
+        }
+    }
+    return accepted >= a.majority(), nil
+}
+
+// Reserve a fresh range big enough for n IDs
+func (a *Allocator) acquire(n membertable.IDNum) error {
+    for {
+        old, err := a.readCounter()
+        if err != nil {
+            return err
+        }
+        new := old + n + reserveSize
+        ok, err := a.advanceCounter(old, new)
+        if err != nil {
+            return err
+        }
+        if ok {
+            a.next, a.limit = old, new
+            return nil
+        }
+        // Another allocator moved the counter first; read it again
+    }
+}
+
+// Hand out a block of n IDs
+func (a *Allocator) Lease(n membertable.IDNum) (Block, error) {
+    a.leaseMutex.Lock()
+    defer a.leaseMutex.Unlock()
+
+    if n < 1 {
+        n = 1
+    }
+    if a.limit - a.next < n {
+        if err := a.acquire(n); err != nil {
+            return Block{}, err
+        }
+    }
+    block := Block{a.next, a.next + n}
+    a.next += n
+    return block, nil
+}
+
+// Hand out a single ID
+func (a *Allocator) Next() (membertable.IDNum, error) {
+    block, err := a.Lease(1)
+    return block.Start, err
+}
+
+func (a *Allocator) RPCLease(n membertable.IDNum, block *Block) error {
+    var err error
+    *block, err = a.Lease(n)
+    return err
+}
+
+// Hands out IDs from blocks leased from any of the given allocators, so only
+// one request in blockSize goes over the network
+type BlockClient struct {
+    Allocators []string
+    BlockSize membertable.IDNum
+
+    block Block
+}
+
+func (c *BlockClient) Next() (membertable.IDNum, error) {
+    if c.block.Start >= c.block.End {
+        block, err := LeaseBlock(c.Allocators, c.BlockSize)
+        if err != nil {
+            return 0, err
+        }
+        c.block = block
+    }
+    id := c.block.Start
+    c.block.Start++
+    return id, nil
+}
+
+// Lease a block of n IDs from the first of the given allocators that answers
+func LeaseBlock(allocators []string, n membertable.IDNum) (Block, error) {
+    err := error(ErrNoQuorum)
+    for _, addr := range allocators {
+        client, dialErr := rpc.DialHTTP("tcp", addr)
+        if dialErr != nil {
+            err = dialErr
+            continue
+        }
+        var block Block
+        err = client.Call("Allocator.RPCLease", n, &block)
+        client.Close()
+        if err == nil {
+            return block, nil
+        }
+    }
+    return Block{}, err
+}
@@ -0,0 +1,115 @@
+package leader
+
+import (
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/rpc"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+
+    "membertable"
+)
+
+func TestAllocatorSurvivesRestart(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "allocator")
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "id.bin")
+
+    seen := make(map[membertable.IDNum]bool)
+    for restart := 0; restart < 3; restart++ {
+        a, err := NewAllocator(filename)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 100; i++ {
+            id, err := a.Next()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if seen[id] {
+                t.Fatalf("id %v handed out twice", id)
+            }
+            seen[id] = true
+        }
+    }
+}
+
+// Start an allocator with its own RPC server and return its address
+func startAllocator(t *testing.T, dir string, name string) (*Allocator, net.Listener) {
+    a, err := NewAllocator(filepath.Join(dir, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := rpc.NewServer()
+    server.Register(a)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go http.Serve(l, server)
+    return a, l
+}
+
+func TestReplicatedAllocators(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "allocator")
+    defer os.RemoveAll(dir)
+
+    var allocators []*Allocator
+    var listeners []net.Listener
+    for _, name := range []string{"a", "b", "c"} {
+        a, l := startAllocator(t, dir, name)
+        allocators = append(allocators, a)
+        listeners = append(listeners, l)
+    }
+    for i, a := range allocators {
+        for j, l := range listeners {
+            if i != j {
+                a.Peers = append(a.Peers, l.Addr().String())
+            }
+        }
+    }
+
+    // Lease from every allocator at once; no ID may come out twice
+    var mutex sync.Mutex
+    seen := make(map[membertable.IDNum]bool)
+    lease := func(a *Allocator) {
+        for i := 0; i < 50; i++ {
+            block, err := a.Lease(10)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            mutex.Lock()
+            for id := block.Start; id < block.End; id++ {
+                if seen[id] {
+                    t.Errorf("id %v handed out twice", id)
+                }
+                seen[id] = true
+            }
+            mutex.Unlock()
+        }
+    }
+    var wg sync.WaitGroup
+    for _, a := range allocators {
+        wg.Add(1)
+        go func(a *Allocator) {
+            defer wg.Done()
+            lease(a)
+        }(a)
+    }
+    wg.Wait()
+
+    // Losing one replica still leaves a majority
+    listeners[2].Close()
+    lease(allocators[0])
+
+    // Losing two does not
+    listeners[1].Close()
+    allocators[0].next = allocators[0].limit
+    if _, err := allocators[0].Lease(1); err != ErrNoQuorum {
+        t.Error("leased without a majority:", err)
+    }
+}
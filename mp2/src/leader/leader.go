@@ -2,85 +2,64 @@ package leader
 
 import (
     "encoding/binary"
+    "log"
     "net"
-    "os"
     "membertable"
 )
 
 const idFilename = "id.bin"
 
+// Where Run hands out IDs
+const DefaultAddress = ":38449"
+
 func handleRequest(c net.Conn, id membertable.IDNum) {
     defer c.Close()
     binary.Write(c, binary.BigEndian, id)
 }
 
-// Return the next ID (stored in the ID file) and write out the new next ID to the ID file.
-func IncrementIDFile() (membertable.IDNum, error) {
-    f, err := os.OpenFile(idFilename, os.O_RDWR | os.O_CREATE, os.ModePerm)
-    if err != nil {
-        return 0, err
-    }
-
-    defer f.Close()
-
-    fi, err := f.Stat()
-    if err != nil {
-        return 0, err
-    }
-
-    // A zero file size means there was no ID file, so we should create one with the second ID
-    // (which is 1) and return the starting ID (which is 1).
-    if fi.Size() == 0 {
-        err = binary.Write(f, binary.BigEndian, membertable.IDNum(1))
-        return 0, err
-    }
-
-    // Read the id which we will return
-    var id membertable.IDNum
-    if err = binary.Read(f, binary.BigEndian, &id); err != nil {
-        return 0, err
-    }
-
-    // Move to the beginning of the file and erase it
-    if _, err = f.Seek(0, 0); err != nil {
-        return id, err
-    }
-
-    if err = f.Truncate(0); err != nil {
-        return id, err
-    }
-
-    // Write out what the next id should be, but do not return it
-    err = binary.Write(f, binary.BigEndian, membertable.IDNum(id + 1))
-    return id, err
-}
-
 // Continually run and pass out monotomically increasing IDs to users as they request then.
 // Connecting to us implcitly requests a new ID, which we will never pass out again.
 func Run() error {
-    ln, err := net.Listen("tcp", ":38449")
+    a, err := NewAllocator(idFilename)
     if err != nil {
         return err
     }
+    return Serve(DefaultAddress, a)
+}
 
+// Same as Run, but with the given address and allocator
+func Serve(address string, a IDSource) error {
+    ln, err := net.Listen("tcp", address)
+    if err != nil {
+        return err
+    }
+    defer ln.Close()
+    return ServeListener(ln, a)
+}
 
+// Hand out IDs to whoever connects to ln until it is closed
+func ServeListener(ln net.Listener, a IDSource) error {
     for {
         conn, err := ln.Accept()
         if err != nil {
-            continue
+            if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+                continue
+            }
+            return err
         }
 
-        // Get the next ID
-        nextID, err := IncrementIDFile()
+        // Get the next ID. Without one the caller is hung up on and tries
+        // again; the listener stays up for the next request.
+        nextID, err := a.Next()
         if err != nil {
-            return err
+            log.Println("could not get an id:", err)
+            conn.Close()
+            continue
         }
 
         // Send it out
         go handleRequest(conn, nextID)
     }
-
-    return nil
 }
 
 // Connect to the given leader and get a new ID for the group they lead.
@@ -99,3 +78,15 @@ func RequestID(leaderAddress string) (membertable.IDNum, error) {
 
     return id, nil
 }
+
+// Ask each of the given leaders for an ID in turn until one answers
+func RequestIDFrom(leaderAddresses []string) (membertable.IDNum, error) {
+    err := error(ErrNoQuorum)
+    for _, addr := range leaderAddresses {
+        var id membertable.IDNum
+        if id, err = RequestID(addr); err == nil {
+            return id, nil
+        }
+    }
+    return 0, err
+}
@@ -0,0 +1,39 @@
+package leader
+
+import (
+    "errors"
+    "net"
+    "testing"
+
+    "membertable"
+)
+
+// Fails the first Next, then counts up
+type flakySource struct {
+    calls int
+}
+
+func (f *flakySource) Next() (membertable.IDNum, error) {
+    f.calls++
+    if f.calls == 1 {
+        return 0, errors.New("no quorum")
+    }
+    return membertable.IDNum(f.calls), nil
+}
+
+func TestServeSurvivesFailedNext(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go ServeListener(ln, &flakySource{})
+
+    if _, err := RequestID(ln.Addr().String()); err == nil {
+        t.Fatal("got an id while the source was failing")
+    }
+    id, err := RequestID(ln.Addr().String())
+    if err != nil || id != 2 {
+        t.Error("after the failure got", id, err)
+    }
+}
@@ -0,0 +1,103 @@
+package leader
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "sync"
+
+    "membertable"
+    "raft"
+)
+
+// Anything that can hand out IDs for Serve
+type IDSource interface {
+    Next() (membertable.IDNum, error)
+}
+
+// Moves the ID counter forward by N when committed
+type LeaseCommand struct {
+    N membertable.IDNum
+}
+
+func init() {
+    gob.Register(LeaseCommand{})
+}
+
+// The ID counter as a raft state machine. Every lease is an entry in the
+// log, so all members agree on exactly which IDs have been handed out.
+type IDLog struct {
+    counter membertable.IDNum
+    mutex sync.Mutex
+}
+
+func (l *IDLog) Apply(index int64, command interface{}) interface{} {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    lease := command.(LeaseCommand)
+    block := Block{l.counter, l.counter + lease.N}
+    l.counter = block.End
+    return block
+}
+
+func (l *IDLog) Snapshot() ([]byte, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    var buf bytes.Buffer
+    err := binary.Write(&buf, binary.BigEndian, l.counter)
+    return buf.Bytes(), err
+}
+
+func (l *IDLog) Restore(snapshot []byte) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return binary.Read(bytes.NewReader(snapshot), binary.BigEndian, &l.counter)
+}
+
+func (l *IDLog) Counter() membertable.IDNum {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return l.counter
+}
+
+// Hands out IDs by committing leases through raft. Only the raft leader can
+// lease; everyone else gets raft.ErrNotLeader.
+type RaftAllocator struct {
+    Raft *raft.Raft
+
+    // the range this member committed and has not handed out yet
+    reserved Block
+    mutex sync.Mutex
+}
+
+func (a *RaftAllocator) Lease(n membertable.IDNum) (Block, error) {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    if n < 1 {
+        n = 1
+    }
+    if a.reserved.End - a.reserved.Start < n {
+        result, err := a.Raft.Propose(LeaseCommand{n + reserveSize})
+        if err != nil {
+            return Block{}, err
+        }
+        a.reserved = result.(Block)
+    }
+    block := Block{a.reserved.Start, a.reserved.Start + n}
+    a.reserved.Start += n
+    return block, nil
+}
+
+func (a *RaftAllocator) Next() (membertable.IDNum, error) {
+    block, err := a.Lease(1)
+    return block.Start, err
+}
+
+// Registered under the name "Allocator", so LeaseBlock works against either
+// kind of allocator
+func (a *RaftAllocator) RPCLease(n membertable.IDNum, block *Block) error {
+    var err error
+    *block, err = a.Lease(n)
+    return err
+}
@@ -0,0 +1,58 @@
+package leader
+
+import (
+    "testing"
+    "time"
+
+    "membertable"
+    "raft"
+)
+
+func TestRaftAllocatorSurvivesRestart(t *testing.T) {
+    persister := &raft.MemoryPersister{}
+    seen := make(map[membertable.IDNum]bool)
+    for restart := 0; restart < 3; restart++ {
+        r, err := raft.New("me", []string{"me"}, &IDLog{}, persister)
+        if err != nil {
+            t.Fatal(err)
+        }
+        r.Start()
+        for !r.IsLeader() {
+            time.Sleep(10 * time.Millisecond)
+        }
+
+        a := &RaftAllocator{Raft: r}
+        for i := 0; i < 100; i++ {
+            id, err := a.Next()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if seen[id] {
+                t.Fatalf("id %v handed out twice", id)
+            }
+            seen[id] = true
+        }
+        r.Stop()
+    }
+}
+
+func TestIDLogSnapshot(t *testing.T) {
+    var l IDLog
+    l.Apply(1, LeaseCommand{10})
+    l.Apply(2, LeaseCommand{5})
+    data, err := l.Snapshot()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var restored IDLog
+    if err = restored.Restore(data); err != nil {
+        t.Fatal(err)
+    }
+    if restored.Counter() != 15 {
+        t.Fatal("restored counter is", restored.Counter())
+    }
+    if block := restored.Apply(3, LeaseCommand{1}).(Block); block.Start != 15 {
+        t.Fatal("lease after restore started at", block.Start)
+    }
+}
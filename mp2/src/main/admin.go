@@ -0,0 +1,83 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "membertable"
+    "net/rpc"
+    "os"
+    "text/tabwriter"
+    "time"
+)
+
+var errAdminUsage = errors.New("usage: main -admin <addr> members|evict <address>|stats|resize")
+
+// Run one admin command against the member at addr and print the result
+func runAdmin(addr string, args []string) error {
+    if len(args) == 0 {
+        return errAdminUsage
+    }
+
+    client, err := rpc.DialHTTP("tcp", addr)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+
+    switch args[0] {
+    case "members":
+        var infos []membertable.MemberInfo
+        if err = client.Call("Table.RPCGetMembers", 0, &infos); err != nil {
+            return err
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+        fmt.Fprintln(w, "ADDRESS\tNAME\tINCARNATION\tHEARTBEAT\tAGE\tSTATUS")
+        for _, info := range infos {
+            mem := info.Member
+            fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\t%s\n", mem.ID.Address, mem.ID.Name,
+                        mem.Incarnation, mem.HeartbeatID, info.Age.Truncate(time.Millisecond), info.Status)
+        }
+        return w.Flush()
+
+    case "evict":
+        if len(args) != 2 {
+            return errAdminUsage
+        }
+        var dummy int
+        if err = client.Call("Table.RPCEvict", args[1], &dummy); err != nil {
+            return err
+        }
+        fmt.Println("evicted member", args[1])
+        return nil
+
+    case "resize":
+        // Forget members that left for good, so the quorum is a majority of
+        // the members alive now
+        var status membertable.PartitionStatus
+        if err = client.Call("Table.RPCResetExpectedSize", 0, &status); err != nil {
+            return err
+        }
+        fmt.Println("expected size", status.Expected, "quorum", status.Quorum)
+        return nil
+
+    case "stats":
+        var stats membertable.Stats
+        if err = client.Call("Table.RPCGetStats", 0, &stats); err != nil {
+            return err
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+        fmt.Fprintf(w, "member\t%s %s\n", stats.Me.Address, stats.Me.Name)
+        fmt.Fprintf(w, "incarnation\t%d\n", stats.Incarnation)
+        fmt.Fprintf(w, "heartbeat\t%d\n", stats.HeartbeatID)
+        fmt.Fprintf(w, "alive\t%d\n", stats.Alive)
+        fmt.Fprintf(w, "failed\t%d\n", stats.Failed)
+        fmt.Fprintf(w, "evicted\t%d\n", stats.Evicted)
+        fmt.Fprintf(w, "heartbeats sent\t%d\n", stats.HeartbeatsSent)
+        fmt.Fprintf(w, "send errors\t%d\n", stats.SendErrors)
+        fmt.Fprintf(w, "heartbeats received\t%d\n", stats.HeartbeatsReceived)
+        fmt.Fprintf(w, "refutations\t%d\n", stats.Refutations)
+        fmt.Fprintf(w, "evictions\t%d\n", stats.Evictions)
+        return w.Flush()
+    }
+    return errAdminUsage
+}
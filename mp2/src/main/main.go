@@ -2,20 +2,29 @@ package main
 
 import (
     "flag"
+    "fmt"
     "io"
     "log"
+    "election"
+    "leader"
     "membertable"
     "net"
     "os"
     "net/rpc"
     "net/http"
-    "strconv"
+    "raft"
+    "strings"
+    "time"
 )
 
 var listenAddress = flag.String("bind", ":7777", "the address for listening")
-var seedAddress = flag.String("seed", "", "the address of some machine to grab the inital membertable from")
+var seedAddress = flag.String("seed", "", "comma separated addresses (or DNS names, or _service._proto SRV names) of machines to grab the inital membertable from, tried in order")
 var machineName = flag.String("name", "", "the name of this machine")
 var logFile = flag.String("logs", "machine.log", "the file name to store the log in")
+var idPeers = flag.String("idpeers", "", "comma separated addresses of the other machines replicating the ID counter")
+var adminAddress = flag.String("admin", "", "run an admin command (members, evict <address>, stats or resize) against the machine at this address and exit")
+var tags = flag.String("tags", "", "space separated key=value tags to publish with our membership entry, like \"zone=us-east\"")
+var raftPeers = flag.String("raft", "", "comma separated addresses of every machine in the raft group (including this one), the same on every machine and fixed for the life of the group; IDs are then committed through raft")
 
 func getIP(hostname string) string {
     machineIP, err := net.InterfaceAddrs()
@@ -44,9 +53,68 @@ func getIP(hostname string) string {
 // Choose a color for a given ID
 // TODO maybe move this to membertable
 
+// Run the ID service whenever we are the elected leader
+func followLeader(changes <-chan election.Change, allocator leader.IDSource) {
+    var ln net.Listener
+    for change := range changes {
+        if change.IsMe && ln == nil {
+            var err error
+            if ln, err = net.Listen("tcp", leader.DefaultAddress); err != nil {
+                log.Println("could not start id service:", err)
+                ln = nil
+                continue
+            }
+            log.Println("elected leader; handing out ids on", leader.DefaultAddress)
+            go leader.ServeListener(ln, allocator)
+        }
+        if !change.IsMe && ln != nil {
+            log.Println("no longer leader; stopping id service")
+            ln.Close()
+            ln = nil
+        }
+    }
+}
+
+// Turn raft leadership into the same changes the election gives
+func followRaft(r *raft.Raft) <-chan election.Change {
+    changes := make(chan election.Change)
+    go func() {
+        var term int64
+        wasLeader := false
+        for {
+            isLeader := r.IsLeader()
+            if isLeader != wasLeader {
+                term++
+                changes <- election.Change{Leader: membertable.ID{Address: r.Leader()}, Term: term, IsMe: isLeader}
+                wasLeader = isLeader
+            }
+            time.Sleep(election.CheckInterval)
+        }
+    }()
+    return changes
+}
+
+// Answers leader lookups in raft mode, in place of the election
+type raftElection struct {
+    raft *raft.Raft
+}
+
+func (e raftElection) RPCCurrentLeader(dummy int, leader *membertable.ID) error {
+    *leader = membertable.ID{Address: e.raft.Leader()}
+    return nil
+}
+
 func main() {
     flag.Parse()
 
+    if *adminAddress != "" {
+        if err := runAdmin(*adminAddress, flag.Args()); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+
     fatalChan := make(chan bool)
 
     // Get the machines name
@@ -58,7 +126,7 @@ func main() {
         bindAddress = getIP(hostname)
     }
 
-    id, idErr := membertable.IncrementIDFile(bindAddress + "_" + bindPort + ".bin")
+    id, incarnation, idErr := membertable.NextIncarnation(bindAddress + "_" + bindPort + ".bin")
     if idErr != nil {
         log.Println("Error retriving id number")
         id = 0
@@ -78,10 +146,18 @@ func main() {
     }
 
     var t membertable.Table
-    t.Init(myID)
+    t.InitIncarnation(myID, incarnation)
+    if *tags != "" {
+        t.SetTags(membertable.ParseTags(*tags))
+    }
+    t.Seeds = membertable.ParseSeeds(*seedAddress)
+    t.SnapshotFile = bindAddress + "_" + bindPort + ".members"
+    if err := t.LoadSnapshot(t.SnapshotFile); err != nil {
+        log.Println("could not load membership snapshot:", err)
+    }
 
     // Configure the log file to be something nice
-    log.SetPrefix("[\x1B[" + myID.GetColor() + "m" + myID.Name + " " + strconv.Itoa(int(myID.Num)) + " " + bindAddress + "\x1B[0m]:")
+    log.SetPrefix("[\x1B[" + myID.GetColor() + "m" + myID.Name + " " + bindAddress + "\x1B[0m]:")
     log.SetFlags(0)
 
     logfd, err := os.Create(*logFile + myID.Name)
@@ -95,23 +171,61 @@ func main() {
     log.Println("Name     :", myID.Name)
     log.Println("IP       :", bindAddress)
     log.Println("Address  :", myID.Address)
-    log.Println("ID       :", myID.Num)
+    log.Println("Incarn.  :", incarnation)
 
-    if *seedAddress != "" {
+    if len(t.Seeds) > 0 {
         log.Printf("sending heartbeat to seed member")
-        if err = t.SendHeartbeatToAddress(*seedAddress); err != nil {
+        if err = t.JoinSeeds(); err != nil {
+            // We keep going back to the seeds while we are alone
+            log.Println(err, "; will retry")
+        }
+    }
+
+    if *raftPeers != "" {
+        // IDs are committed through the raft log, and whoever leads the raft
+        // group hands them out
+        r, err := raft.NewFixed(myID.Address, strings.Split(*raftPeers, ","), &leader.IDLog{},
+                           &raft.FilePersister{Filename: "raft_" + bindPort + ".state"})
+        if err != nil {
+            log.Fatal(err)
+        }
+        allocator := &leader.RaftAllocator{Raft: r}
+        go followLeader(followRaft(r), allocator)
+        r.Start()
+        rpc.Register(r)
+        rpc.RegisterName("Allocator", allocator)
+        rpc.RegisterName("Election", raftElection{r})
+    } else {
+        // Every machine keeps a replica of the ID counter; whoever is elected
+        // leader also hands IDs out
+        allocator, err := leader.NewAllocator("id_" + bindPort + ".bin")
+        if err != nil {
             log.Fatal(err)
         }
+        if *idPeers != "" {
+            allocator.Peers = strings.Split(*idPeers, ",")
+        }
+        elect := election.New(&t, myID)
+        go followLeader(elect.Events(), allocator)
+        go elect.Run()
+        rpc.Register(allocator)
+        rpc.Register(elect)
     }
 
     rpc.Register(&t)
     rpc.HandleHTTP()
+    t.HandleMetrics()
     l, e := net.Listen("tcp", ":" + bindPort)
     log.Print("Bindport: " + bindPort)
     if e != nil {
         log.Print("RPC bind failure")
     }
     go http.Serve(l, nil)
+
+    // Heartbeats go over UDP on the same port; without it they fall back to RPC
+    if err := t.ListenUDP(":" + bindPort); err != nil {
+        log.Println("could not listen for udp heartbeats:", err)
+    }
     go t.SendHeartbeatProcess(fatalChan)
 
     <-fatalChan
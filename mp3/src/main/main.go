@@ -257,7 +257,7 @@ func runServer(g *mykv.KVGraph) {
 
     var t membertable.Table
     t.Init(myID)
-    t.Changed = func(t *membertable.Table) {
+    t.Changed = func(t *membertable.Table, changed []membertable.ID, dropped bool) {
         log.Println("membertable changed")
         g.SetByMembertable(t.ActiveMembers())
         myVertex := g.FindNode(mykv.HashedKey(myID.Hashed()))
@@ -22,24 +22,29 @@ import (
     "mykv"
     "membertable"
     "movie"
+    "raft"
+    "rpcpool"
 )
 
 var listenAddress = flag.String("bind", ":7777", "the address for listening to services")
-var seedAddress = flag.String("seed", "", "the address of some machine to grab the inital membertable from")
+var seedAddress = flag.String("seed", "", "comma separated addresses (or DNS names, or _service._proto SRV names) of machines to grab the inital membertable from, tried in order")
 var machineName = flag.String("name", "", "the name of this machine")
 var logFile = flag.String("logs", "machine.log", "the file name to store the log in")
 var command = flag.String("run", "", "command to run")
 var interactive = flag.Bool("interactive", false, "set to true to run interactively; cancels running a node and run command")
 var movieInteractive = flag.Bool("movie", false, "set to true to run interactively in movie search mode")
 var loadMovie = flag.Bool("load", false, "set to true to cause the machines to load the movie index")
-
-type HTTPRPCConnector struct {
-
-}
-
-func (c HTTPRPCConnector) Connect(addr string) (*rpc.Client, error) {
-    return rpc.DialHTTP("tcp", addr)
-}
+var storeKind = flag.String("store", "disk", "where this machine keeps its keys: disk, lsm for more keys than fit in memory, or memory to lose them on exit")
+var fsyncPolicy = flag.String("fsync", "batch", "when disk writes are flushed: always, batch (every 100ms) or never")
+var lastWriteWins = flag.Bool("lww", false, "settle concurrent writes by client time instead of keeping them as siblings; must be the same on every machine")
+var expectedSize = flag.Int("expected", 0, "the number of machines in the cluster; defaults to the most ever seen at once")
+var tags = flag.String("tags", "", "space separated key=value tags to publish with our membership entry, like \"rack=r1 roles=kv,grep\"")
+var tokens = flag.Int("tokens", mykv.TokensPerWeight, "ring tokens per unit of weight; must be the same on every machine")
+var repairRate = flag.Int("repair-rate", mykv.DefaultRepairKeysPerSecond, "how many keys a second anti-entropy may send or fetch; 0 for no limit")
+var raftPeers = flag.String("raft", "", "comma separated addresses of every machine in the raft group (including this one), the same on every machine and fixed for the life of the group; the ring is then committed through raft")
+
+// How often the raft leader compares the ring with its membertable
+const ringCheckInterval = 500 * time.Millisecond
 
 type Controller struct {
     g *mykv.KVGraph
@@ -61,8 +66,20 @@ func (c *Controller) LoadMovies(args *int, reply *bool) error {
     return nil
 }
 
+// Connect to the first seed that answers
+func dialSeed() (*rpc.Client, error) {
+    err := error(membertable.ErrNoSeeds)
+    for _, addr := range membertable.ParseSeeds(*seedAddress) {
+        var client *rpc.Client
+        if client, err = rpc.DialHTTP("tcp", addr); err == nil {
+            return client, nil
+        }
+    }
+    return nil, err
+}
+
 func loadMovies() {
-    client, err := rpc.DialHTTP("tcp", *seedAddress)
+    client, err := dialSeed()
     if err != nil {
         log.Printf("error connecting to seed: %v", err)
         return
@@ -136,7 +153,7 @@ func handleInsert(params []string, g *mykv.KVGraph) bool {
         log.Println("invalid consistancy level")
         return true
     }
-    kv := mykv.KeyValue{ mykv.Key(keyUint), mykv.StampNow(), params[3] }
+    kv := mykv.KeyValue{Key: mykv.Key(keyUint), Time: mykv.StampNow(), Value: params[3]}
     if err := g.Insert(kv, c); err != nil {
         log.Println("insert error: ", err)
         return true
@@ -159,7 +176,13 @@ func handleUpdate(params []string, g *mykv.KVGraph) bool {
         log.Println("invalid consistancy level")
         return true
     }
-    kv := mykv.KeyValue{ mykv.Key(keyUint), mykv.StampNow(), params[3] }
+    // Supersede every version there is now, concurrent ones included
+    siblings, err := g.Lookup(mykv.Key(keyUint), c)
+    if err != nil {
+        log.Println("update error: ", err)
+        return true
+    }
+    kv := mykv.KeyValue{Key: mykv.Key(keyUint), Time: mykv.StampNow(), Version: siblings.Context(), Value: params[3]}
     if err := g.Update(kv, c); err != nil {
         log.Println("update error: ", err)
         return true
@@ -182,14 +205,19 @@ func handleLookup(params []string, g *mykv.KVGraph) bool {
         log.Println("invalid consistancy level")
         return true
     }
-    kv, err := g.Lookup(mykv.Key(keyUint), c)
+    siblings, err := g.Lookup(mykv.Key(keyUint), c)
     if err != nil {
         log.Println("lookup error: ", err)
         return true
     }
-    if kv != nil {
+    siblings = siblings.Live()
+    if len(siblings) > 1 {
+        fmt.Println(len(siblings), "concurrent versions; update the key to resolve them")
+    }
+    for _, kv := range siblings {
         fmt.Println(kv.Value)
-    } else {
+    }
+    if len(siblings) == 0 {
         fmt.Println("key does not exist")
     }
     return true
@@ -308,6 +336,24 @@ func getColor(id uint32) string {
     return "0";
 }
 
+// While we lead the raft group, commit our active members as the ring
+// whenever they differ from it
+func proposeRing(r *raft.Raft, ringLog *mykv.RingLog, t *membertable.Table) {
+    for {
+        time.Sleep(ringCheckInterval)
+        if !r.IsLeader() {
+            continue
+        }
+        members := mykv.RingMembers(t.ActiveMembersWithRole(membertable.RoleKV))
+        if ringLog.Current().Same(members) {
+            continue
+        }
+        if _, err := r.Propose(mykv.SetRingCommand{Members: members}); err != nil {
+            log.Println("could not commit ring:", err)
+        }
+    }
+}
+
 func runServer(g *mykv.KVGraph) {
     // Get the machines name
     hostname, _ := os.Hostname()
@@ -323,7 +369,7 @@ func runServer(g *mykv.KVGraph) {
         bindAddress = getIP(hostname)
     }
 
-    id, idErr := membertable.IncrementIDFile(bindAddress + "_" + bindPort + ".bin")
+    id, incarnation, idErr := membertable.NextIncarnation(bindAddress + "_" + bindPort + ".bin")
     if idErr != nil {
         log.Println("Error retriving id number")
         id = 0
@@ -342,16 +388,87 @@ func runServer(g *mykv.KVGraph) {
         myID.Name = hostname
     }
 
-    localNode := mykv.NewNode(mykv.HashedKey(myID.Hashed()))
+    var store mykv.Store = mykv.NewMemoryStore()
+    policy := mykv.SyncBatch
+    switch *fsyncPolicy {
+        case "always": policy = mykv.SyncAlways
+        case "never": policy = mykv.SyncNever
+    }
+    storeDir := bindAddress + "_" + bindPort + ".kv"
+    switch *storeKind {
+        case "disk":
+            diskStore, err := mykv.OpenDiskStore(storeDir, policy)
+            if err != nil {
+                log.Println("could not open the key store:", err)
+                return
+            }
+            log.Println("recovered", diskStore.Len(), "keys from disk")
+            store = diskStore
+        case "lsm":
+            lsmStore, err := mykv.OpenLSMStore(storeDir, policy)
+            if err != nil {
+                log.Println("could not open the key store:", err)
+                return
+            }
+            store = lsmStore
+    }
+    localNode := mykv.NewNodeWithStore(mykv.HashedKey(myID.Hashed()), store)
+    localNode.Name = myID.Address
+    localNode.Policy = g.Policy
 
     var t membertable.Table
-    t.Init(myID)
-    t.Changed = func(t *membertable.Table, changedMembers []membertable.ID, dropped bool) {
-        log.Println("membertable changed")
-        g.SetByMembertable(t.ActiveMembers())
-        myVertex := g.FindNode(mykv.HashedKey(myID.Hashed()))
-        myVertex.LocalNode = localNode
-        go g.HandleStaleKeys(changedMembers, dropped)
+    t.InitIncarnation(myID, incarnation)
+    t.ExpectedSize = *expectedSize
+    if *tags != "" {
+        t.SetTags(membertable.ParseTags(*tags))
+    }
+    t.Seeds = membertable.ParseSeeds(*seedAddress)
+    // Whoever we knew before a restart gets probed, so a whole cluster can
+    // come back without waiting on a seed
+    t.SnapshotFile = bindAddress + "_" + bindPort + ".members"
+    if err := t.LoadSnapshot(t.SnapshotFile); err != nil {
+        log.Println("could not load membership snapshot:", err)
+    }
+    g.Minority = t.InMinority
+    setLocalNode := func() {
+        g.SetLocalNode(myID.Address, localNode)
+    }
+
+    var ringRaft *raft.Raft
+    var ringLog *mykv.RingLog
+    if *raftPeers != "" {
+        // The ring only changes when the raft leader commits a new one, so
+        // every node moves through the same versions
+        ringLog = &mykv.RingLog{}
+        ringLog.Changed = func(ring mykv.Ring, joined, left []membertable.ID) {
+            log.Println("ring is now version", ring.Version)
+            g.SetByRing(ring)
+            setLocalNode()
+            if len(joined) > 0 {
+                go g.HandleStaleKeys(joined, false)
+                go g.ReplayHints(joined)
+            }
+            if len(left) > 0 {
+                go g.HandleStaleKeys(left, true)
+            }
+        }
+        ringRaft, err = raft.NewFixed(myID.Address, strings.Split(*raftPeers, ","), ringLog,
+                                 &raft.FilePersister{Filename: "raft_" + bindPort + ".state"})
+        if err != nil {
+            log.Println("could not start raft:", err)
+            return
+        }
+    } else {
+        t.Changed = func(t *membertable.Table, changedMembers []membertable.ID, dropped bool) {
+            log.Println("membertable changed")
+            g.SetByMembertable(t.ActiveMembersWithRole(membertable.RoleKV))
+            setLocalNode()
+            go g.HandleStaleKeys(changedMembers, dropped)
+            if !dropped {
+                // members that were down get the writes they missed
+                go g.ReplayHints(changedMembers)
+            }
+        }
     }
 
     addr := bindAddress + ":" + bindPort
@@ -371,29 +488,49 @@ func runServer(g *mykv.KVGraph) {
     log.Println("IP       :", bindAddress)
     log.Println("Address  :", addr)
 
+    // Heartbeats go over UDP on the same port; without it they fall back to RPC
+    if err := t.ListenUDP(*listenAddress); err != nil {
+        log.Println("could not listen for udp heartbeats:", err)
+    }
+
     go t.SendHeartbeatProcess(nil)
 
     s := Controller{g}
 
     rpc.Register(&s)
     rpc.Register(localNode)
+    antiEntropy := mykv.NewAntiEntropy(g)
+    antiEntropy.KeysPerSecond = *repairRate
+    rpc.Register(antiEntropy)
     rpc.Register(&t)
+    if ringRaft != nil {
+        rpc.Register(ringRaft)
+        rpc.Register(ringLog)
+    }
     rpc.HandleHTTP()
+    t.HandleMetrics()
     l, err := net.Listen("tcp", *listenAddress)
     if err != nil {
         log.Println(err)
         return
     }
 
-    if *seedAddress != "" {
+    if len(t.Seeds) > 0 {
         log.Printf("sending heartbeat to seed member")
-        if err = t.SendHeartbeatToAddress(*seedAddress); err != nil {
-             log.Println(err)
-            return
+        if err = t.JoinSeeds(); err != nil {
+            // We keep going back to the seeds while we are alone
+            log.Println(err, "; will retry")
         }
     }
 
-    go g.RandomRepairProcess()
+    if ringRaft != nil {
+        ringRaft.Start()
+        go proposeRing(ringRaft, ringLog, &t)
+    }
+
+    go antiEntropy.Process()
+    go g.HintProcess()
+    go localNode.TombstoneProcess()
 
     // Setup a signal for showing the last 10 reads/writes
     usrSigChan := make(chan os.Signal, 0)
@@ -414,8 +551,14 @@ func runServer(g *mykv.KVGraph) {
         exitMutex.Lock()
         log.Printf("got signal %v", sig)
         t.Changed = nil
+        if ringRaft != nil {
+            ringRaft.Stop()
+        }
         l.Close()
         g.RemoveLocalNodes()
+        if err := store.Close(); err != nil {
+            log.Println("could not close the key store:", err)
+        }
         exitMutex.Unlock()
     }()
 
@@ -427,9 +570,14 @@ func main() {
     runtime.GOMAXPROCS(2)
     log.SetFlags(0)
     flag.Parse()
+    mykv.TokensPerWeight = *tokens
 
     var g mykv.KVGraph
-    g.Connector = HTTPRPCConnector{}
+    // KV calls share connections with the membertable's
+    g.Connector = rpcpool.Default
+    if *lastWriteWins {
+        g.Policy = mykv.LastWriteWins
+    }
 
     if *loadMovie {
         if *seedAddress == "" {
@@ -45,11 +45,16 @@ func RunInteractive(g *mykv.KVGraph, seedAddress string) {
 
         g.Seed(seedAddress)
 
-        keyvalue, err := g.Lookup(HashTitle(cmd), mykv.All)
+        siblings, err := g.Lookup(HashTitle(cmd), mykv.All)
         if err != nil {
             fmt.Println(err)
             continue
         }
+        keyvalue := siblings.Live().Newest()
+        if keyvalue == nil {
+            fmt.Println("no movies found")
+            continue
+        }
         v := keyvalue.Value
 
         index, ok := v.([]Entry)
@@ -93,7 +98,7 @@ func LoadEntries(g *mykv.KVGraph, r io.Reader) error {
 
             entries = append(entries, Entry{string(entryTitle), string(entryYear)})
         }
-        g.InsertLocal(mykv.KeyValue{k, mykv.StampNow(), entries})
+        g.InsertLocal(mykv.KeyValue{Key: k, Time: mykv.StampNow(), Value: entries})
         if keywordIndex % 100 == 0 {
             runtime.Gosched()
         }
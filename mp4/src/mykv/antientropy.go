@@ -0,0 +1,353 @@
+package mykv
+
+import (
+    "errors"
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+// How long a node waits between rounds of comparing trees with every peer
+const DefaultRepairInterval = 10 * time.Second
+
+// How many keys a node streams a second while repairing, pulled and pushed
+// together
+const DefaultRepairKeysPerSecond = 1000
+
+// How many diverged leaves are fetched in one call
+const repairBatch = 16
+
+// The most versions a peer sends back for one batch; the rest wait for the
+// next round
+const repairPullLimit = 256
+
+var (
+    ErrNoLocalNode = errors.New("no local node to repair")
+)
+
+// Asks for some nodes of the tree over the keys the asker shares with us.
+// Asking for the root starts a walk, and rebuilds the tree if our store or
+// the ring changed since it was built; the rest of the walk uses that tree.
+type TreeRequest struct {
+    Peer string
+    Nodes []int
+}
+
+// Asks for the versions the asker is missing of the keys it shares with us
+// in some leaves. Versions has every version the asker has of them, without
+// their values. At most Limit versions are sent back, if it is set.
+type RangeRequest struct {
+    Peer string
+    Leaves []int
+    Versions Siblings
+    Limit int
+}
+
+// The versions the asker was missing, and which of the asker's Versions we
+// are missing
+type RangeReply struct {
+    Siblings Siblings
+    Wanted []int
+}
+
+// Keeps replicas in sync by comparing merkle trees. For every peer, a node
+// builds a tree over the keys they are both replicas of and walks down both
+// trees from the root, following only the nodes that differ. Only the keys in
+// leaves that differ are exchanged, and each side is sent just the versions
+// it was missing.
+type AntiEntropy struct {
+    Graph *KVGraph
+    Interval time.Duration
+    // 0 for no limit
+    KeysPerSecond int
+
+    trees map[string]cachedTree
+    limiter rateLimiter
+    mutex sync.Mutex
+}
+
+type cachedTree struct {
+    tree *merkleTree
+    // the store and ring change counts it was built at
+    storeChanges int64
+    ringChanges int64
+}
+
+func NewAntiEntropy(g *KVGraph) *AntiEntropy {
+    return &AntiEntropy{
+        Graph: g,
+        Interval: DefaultRepairInterval,
+        KeysPerSecond: DefaultRepairKeysPerSecond,
+        trees: make(map[string]cachedTree),
+    }
+}
+
+// Call fn with every key on our node that peer is also a replica of
+func (a *AntiEntropy) sharedKeys(me *Vertex, peer string, fn func(k Key, siblings Siblings)) {
+    me.LocalNode.Scan(0, func(k Key, siblings Siblings) bool {
+        mine, theirs := false, false
+        for _, v := range a.Graph.FindVerticies(k) {
+            mine = mine || v.Addr == me.Addr
+            theirs = theirs || v.Addr == peer
+        }
+        if mine && theirs {
+            fn(k, siblings)
+        }
+        return true
+    })
+}
+
+func (a *AntiEntropy) buildTree(me *Vertex, peer string) *merkleTree {
+    tree := newMerkleTree()
+    a.sharedKeys(me, peer, tree.add)
+    tree.sum()
+    return tree
+}
+
+// The tree over the keys we share with peer. A cached tree is used unless
+// current is set and our store or the ring changed since it was built.
+func (a *AntiEntropy) tree(me *Vertex, peer string, current bool) *merkleTree {
+    storeChanges, ringChanges := me.LocalNode.changeCount(), a.Graph.ringChangeCount()
+    a.mutex.Lock()
+    cached, ok := a.trees[peer]
+    a.mutex.Unlock()
+    if ok && (!current || cached.storeChanges == storeChanges && cached.ringChanges == ringChanges) {
+        return cached.tree
+    }
+    cached = cachedTree{a.buildTree(me, peer), storeChanges, ringChanges}
+    a.mutex.Lock()
+    a.trees[peer] = cached
+    a.mutex.Unlock()
+    return cached.tree
+}
+
+func (a *AntiEntropy) RPCGetTree(args *TreeRequest, reply *[]uint64) error {
+    me := a.Graph.findLocalNode()
+    if me == nil {
+        return ErrNoLocalNode
+    }
+    root := false
+    for _, n := range args.Nodes {
+        root = root || n == 0
+    }
+    *reply = a.tree(me, args.Peer, root).get(args.Nodes)
+    return nil
+}
+
+// The versions we have of the keys the tree has in leaves. Keys written
+// since the tree was built are left for the next round.
+func inLeaves(node *KVNode, tree *merkleTree, leaves []int) map[Key]Siblings {
+    keys := make(map[Key]Siblings)
+    for _, leaf := range leaves {
+        if leaf < 0 || leaf >= merkleLeaves {
+            continue
+        }
+        for _, k := range tree.keys[leaf] {
+            if siblings := node.Siblings(k); len(siblings) > 0 {
+                keys[k] = siblings
+            }
+        }
+    }
+    return keys
+}
+
+func (a *AntiEntropy) RPCGetRange(args *RangeRequest, reply *RangeReply) error {
+    me := a.Graph.findLocalNode()
+    if me == nil {
+        return ErrNoLocalNode
+    }
+    theirs := make(map[Key]Siblings)
+    for _, kv := range args.Versions {
+        theirs[kv.Key] = append(theirs[kv.Key], kv)
+    }
+    ours := inLeaves(me.LocalNode, a.tree(me, args.Peer, false), args.Leaves)
+    for k, siblings := range ours {
+        for _, kv := range siblings {
+            if args.Limit > 0 && len(reply.Siblings) >= args.Limit {
+                break
+            }
+            if _, news := mergeSibling(theirs[k], kv, a.Graph.Policy); news {
+                reply.Siblings = append(reply.Siblings, kv)
+            }
+        }
+    }
+    for i, kv := range args.Versions {
+        if _, news := mergeSibling(ours[kv.Key], kv, a.Graph.Policy); news {
+            reply.Wanted = append(reply.Wanted, i)
+        }
+    }
+    return nil
+}
+
+// Bring our node and peer in sync on the keys they share. Returns how many
+// versions were sent either way.
+func (a *AntiEntropy) Repair(peer string) (int, error) {
+    me := a.Graph.findLocalNode()
+    if me == nil {
+        return 0, ErrNoLocalNode
+    }
+    mine := a.tree(me, peer, true)
+    remote := &Vertex{Addr: peer}
+
+    // Walk down from the root, one level per call
+    var leaves []int
+    nodes := []int{0}
+    for len(nodes) > 0 {
+        var theirs []uint64
+        if err := a.Graph.callVertex(remote, "AntiEntropy.RPCGetTree", &TreeRequest{me.Addr, nodes}, &theirs); err != nil {
+            return 0, err
+        }
+        var next []int
+        for i, n := range nodes {
+            if i < len(theirs) && theirs[i] == mine.nodes[n] {
+                continue
+            }
+            if isLeafNode(n) {
+                leaves = append(leaves, n - (merkleLeaves - 1))
+            } else {
+                next = append(next, 2 * n + 1, 2 * n + 2)
+            }
+        }
+        nodes = next
+    }
+
+    sent := 0
+    for len(leaves) > 0 {
+        batch := leaves
+        if len(batch) > repairBatch {
+            batch = batch[:repairBatch]
+        }
+        leaves = leaves[len(batch):]
+        n, err := a.repairLeaves(me, remote, mine, batch)
+        sent += n
+        if err != nil {
+            return sent, err
+        }
+    }
+    return sent, nil
+}
+
+func (a *AntiEntropy) repairLeaves(me *Vertex, remote *Vertex, mine *merkleTree, leaves []int) (int, error) {
+    // The peer only needs the versions to tell what either side is missing
+    var ours, versions Siblings
+    for _, siblings := range inLeaves(me.LocalNode, mine, leaves) {
+        for _, kv := range siblings {
+            ours = append(ours, kv)
+            kv.Value = nil
+            versions = append(versions, kv)
+        }
+    }
+
+    // Take the budget before anything is sent: we push at most our versions
+    // and the peer sends back at most repairPullLimit. What goes unused is
+    // given back.
+    reserved := len(ours) + repairPullLimit
+    a.limiter.wait(reserved, a.KeysPerSecond)
+    var reply RangeReply
+    request := &RangeRequest{me.Addr, leaves, versions, repairPullLimit}
+    if err := a.Graph.callVertex(remote, "AntiEntropy.RPCGetRange", request, &reply); err != nil {
+        a.limiter.refund(reserved, a.KeysPerSecond)
+        return 0, err
+    }
+    theirs := reply.Siblings
+    for _, kv := range theirs {
+        var inserted bool
+        me.LocalNode.Insert(&kv, &inserted)
+    }
+
+    // Send back only what they were missing
+    var missing Siblings
+    for _, i := range reply.Wanted {
+        if i >= 0 && i < len(ours) {
+            missing = append(missing, ours[i])
+        }
+    }
+    a.limiter.refund(reserved - len(theirs) - len(missing), a.KeysPerSecond)
+    for _, kv := range missing {
+        if err := a.Graph.insertToVert(kv, remote); err != nil {
+            return len(theirs), err
+        }
+    }
+    return len(theirs) + len(missing), nil
+}
+
+// Every other node on the ring, in order
+func (a *AntiEntropy) peers(me *Vertex) []string {
+    seen := map[string]bool{me.Addr: true}
+    var peers []string
+    for _, v := range a.Graph.NodeIndex {
+        if !seen[v.Addr] {
+            seen[v.Addr] = true
+            peers = append(peers, v.Addr)
+        }
+    }
+    sort.Strings(peers)
+    return peers
+}
+
+// Repair with every peer, one at a time, every Interval
+func (a *AntiEntropy) Process() {
+    for {
+        time.Sleep(a.Interval)
+        me := a.Graph.findLocalNode()
+        if me == nil {
+            continue
+        }
+        for _, peer := range a.peers(me) {
+            n, err := a.Repair(peer)
+            if err != nil {
+                log.Println("repair with", peer, "failed:", err)
+            }
+            if n > 0 {
+                log.Println("repaired", n, "versions with", peer)
+            }
+        }
+    }
+}
+
+// Lets through rate units a second on average, in bursts of up to a second's
+// worth
+type rateLimiter struct {
+    allowance float64
+    last time.Time
+    mutex sync.Mutex
+}
+
+// Block until n more units fit under rate; 0 means no limit
+func (r *rateLimiter) wait(n int, rate int) {
+    if rate <= 0 || n == 0 {
+        return
+    }
+    r.mutex.Lock()
+    now := time.Now()
+    if r.last.IsZero() {
+        r.allowance = float64(rate)
+    } else {
+        r.allowance += now.Sub(r.last).Seconds() * float64(rate)
+        if r.allowance > float64(rate) {
+            r.allowance = float64(rate)
+        }
+    }
+    r.last = now
+    r.allowance -= float64(n)
+    var delay time.Duration
+    if r.allowance < 0 {
+        delay = time.Duration(-r.allowance / float64(rate) * float64(time.Second))
+    }
+    r.mutex.Unlock()
+    time.Sleep(delay)
+}
+
+// Give back n units taken by wait and not used
+func (r *rateLimiter) refund(n int, rate int) {
+    if rate <= 0 || n <= 0 {
+        return
+    }
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.allowance += float64(n)
+    if r.allowance > float64(rate) {
+        r.allowance = float64(rate)
+    }
+}
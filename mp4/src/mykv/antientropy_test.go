@@ -0,0 +1,180 @@
+package mykv
+
+import (
+    "math/rand"
+    "testing"
+    "time"
+)
+
+func TestMerkleTreesIgnoreOrder(t *testing.T) {
+    a, b := newMerkleTree(), newMerkleTree()
+    for k := Key(0); k < 100; k++ {
+        a.add(k, value("x"))
+        b.add(99 - k, value("x"))
+    }
+    a.sum()
+    b.sum()
+    if a.nodes[0] != b.nodes[0] {
+        t.Fatal("same keys gave different roots")
+    }
+
+    // A newer version of one key changes its leaf and the nodes above it
+    b = newMerkleTree()
+    for k := Key(0); k < 100; k++ {
+        siblings := value("x")
+        if k == 42 {
+            siblings[0].Version = VersionVector{"a": 2}
+        }
+        b.add(k, siblings)
+    }
+    b.sum()
+    differ := 0
+    for leaf := 0; leaf < merkleLeaves; leaf++ {
+        if a.nodes[leafNode(leaf)] != b.nodes[leafNode(leaf)] {
+            differ++
+        }
+    }
+    if differ != 1 || a.nodes[0] == b.nodes[0] {
+        t.Error(differ, "leaves differ")
+    }
+}
+
+// Give every node in a pipe graph its own graph and AntiEntropy service
+func newAntiEntropies(g *KVGraph, nodes map[string]*KVNode, connector *pipeConnector) map[string]*AntiEntropy {
+    services := make(map[string]*AntiEntropy)
+    for addr, node := range nodes {
+        local := &KVGraph{Connector: connector}
+        local.SetByRing(Ring{1, ringOf(make([]string, len(nodes))...)})
+        local.SetLocalNode(addr, node)
+        ae := NewAntiEntropy(local)
+        ae.KeysPerSecond = 0
+        connector.servers[addr].Register(ae)
+        services[addr] = ae
+    }
+    return services
+}
+
+// Whether every replica of every key has the same versions
+func replicasAgree(g *KVGraph, nodes map[string]*KVNode, keys []Key) bool {
+    for _, k := range keys {
+        var digest uint64
+        for i, v := range g.FindVerticies(k) {
+            d := keyDigest(k, nodes[v.Addr].Siblings(k))
+            if i > 0 && d != digest {
+                return false
+            }
+            digest = d
+        }
+    }
+    return true
+}
+
+func TestAntiEntropyRepairsOnlyDifferences(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    services := newAntiEntropies(g, nodes, connector)
+    r := rand.New(rand.NewSource(1))
+    var keys []Key
+    for i := 0; i < 200; i++ {
+        k := Key(r.Uint32())
+        keys = append(keys, k)
+        if err := g.Insert(KeyValue{Key: k, Value: "x"}, All); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Replicas that agree have nothing to send
+    for _, peer := range []string{"host1", "host2", "host3"} {
+        if n, err := services["host0"].Repair(peer); err != nil || n != 0 {
+            t.Fatal("repair of consistent replicas sent", n, err)
+        }
+    }
+
+    // host0 loses some keys and misses newer versions of others
+    lost, updated := 0, 0
+    for i, k := range keys {
+        if g.FindVerticies(k)[0].Addr != "host0" {
+            continue
+        }
+        var stored KeyValue
+        if i % 2 == 0 {
+            nodes["host0"].Forget(k)
+            lost++
+        } else {
+            siblings := nodes["host1"].Siblings(k)
+            nodes["host1"].Put(&KeyValue{Key: k, Version: siblings.Context(), Value: "y"}, &stored)
+            updated++
+        }
+    }
+    if lost == 0 || updated == 0 || replicasAgree(g, nodes, keys) {
+        t.Fatal("test keys did not diverge")
+    }
+
+    sent := 0
+    for _, ae := range services {
+        for _, peer := range ae.peers(ae.Graph.findLocalNode()) {
+            n, err := ae.Repair(peer)
+            if err != nil {
+                t.Fatal(err)
+            }
+            sent += n
+        }
+    }
+    if !replicasAgree(g, nodes, keys) {
+        t.Error("replicas still disagree")
+    }
+    // Each diverged key is sent to each of its two other replicas at most
+    // once, and nothing else is sent
+    if sent > 2 * (lost + updated) {
+        t.Error("sent", sent, "versions to repair", lost + updated, "keys")
+    }
+}
+
+func TestTreeRebuiltOnlyAfterChanges(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    ae := newAntiEntropies(g, nodes, connector)["host0"]
+    me := ae.Graph.findLocalNode()
+    if err := g.Insert(KeyValue{Key: 1, Value: "x"}, All); err != nil {
+        t.Fatal(err)
+    }
+
+    tree := ae.tree(me, "host1", true)
+    if ae.tree(me, "host1", true) != tree {
+        t.Error("tree rebuilt with nothing changed")
+    }
+    var inserted bool
+    me.LocalNode.Insert(&KeyValue{Key: 2, Value: "y", Version: VersionVector{"host1": 1}}, &inserted)
+    if ae.tree(me, "host1", false) != tree {
+        t.Error("tree rebuilt in the middle of a walk")
+    }
+    if ae.tree(me, "host1", true) == tree {
+        t.Error("tree not rebuilt after a write")
+    }
+    tree = ae.tree(me, "host1", true)
+    ae.Graph.SetByRing(Ring{2, ringOf("", "", "")})
+    ae.Graph.SetLocalNode("host0", me.LocalNode)
+    if ae.tree(ae.Graph.findLocalNode(), "host1", true) == tree {
+        t.Error("tree not rebuilt after the ring changed")
+    }
+}
+
+func TestRateLimiter(t *testing.T) {
+    var r rateLimiter
+    start := time.Now()
+    // a second's worth goes straight through
+    r.wait(100, 100)
+    if time.Since(start) > 50 * time.Millisecond {
+        t.Error("first burst waited")
+    }
+    r.wait(30, 100)
+    if elapsed := time.Since(start); elapsed < 250 * time.Millisecond {
+        t.Error("over the rate after", elapsed)
+    }
+
+    // what is given back can be used again straight away
+    r.refund(20, 100)
+    start = time.Now()
+    r.wait(20, 100)
+    if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+        t.Error("refunded units waited", elapsed)
+    }
+}
@@ -0,0 +1,405 @@
+package mykv
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "errors"
+    "hash/crc32"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// When the write-ahead log is flushed to disk
+type SyncPolicy int
+
+const (
+    // before every write returns; nothing acknowledged is ever lost
+    SyncAlways SyncPolicy = iota
+    // every SyncInterval; a crash loses at most that much
+    SyncBatch
+    // whenever the OS gets to it
+    SyncNever
+)
+
+const SyncInterval = 100 * time.Millisecond
+
+// How many records the log gets before it is folded into a new snapshot
+const SnapshotEvery = 10000
+
+const (
+    snapshotName = "snapshot"
+    walName = "wal"
+)
+
+var (
+    ErrStoreClosed = errors.New("store is closed")
+    ErrLogDamaged = errors.New("write-ahead log holds a torn record")
+)
+
+// What the stores need of their write-ahead log. Tests swap in logs that fail.
+type walFile interface {
+    io.Writer
+    io.Seeker
+    Truncate(size int64) error
+    Sync() error
+    Close() error
+}
+
+// One change to a key. Each is gob encoded on its own, so a record can be
+// read without any that came before it.
+type walRecord struct {
+    Key Key
+    Siblings Siblings
+    // when each sibling that is a tombstone was learned, so its grace period
+    // carries on across restarts
+    DeletedAt []Timestamp
+    Removed bool
+}
+
+func newRecord(k Key, siblings Siblings) walRecord {
+    record := walRecord{Key: k, Siblings: siblings}
+    for _, s := range siblings {
+        record.DeletedAt = append(record.DeletedAt, s.deletedAt)
+    }
+    return record
+}
+
+// The record's siblings with their tombstone times put back
+func (record walRecord) siblings() Siblings {
+    siblings := append(Siblings(nil), record.Siblings...)
+    for i := range siblings {
+        if i < len(record.DeletedAt) {
+            siblings[i].deletedAt = record.DeletedAt[i]
+        }
+    }
+    return siblings
+}
+
+// Keeps every key in memory and makes changes durable with a write-ahead log
+// in a directory. The log is periodically folded into a snapshot and started
+// over.
+//
+// Log layout: each record is its length (uint32), the CRC-32 of the encoded
+// record (uint32) and the record. A torn or corrupt record ends the log;
+// it and anything after it is cut off when the store is opened.
+type DiskStore struct {
+    Dir string
+    Sync SyncPolicy
+
+    keys map[Key]Siblings
+    wal walFile
+    records int
+    dirty bool
+    closed bool
+    // set if a failed write could not be cut off the log
+    damaged bool
+    mutex sync.Mutex
+}
+
+// Open the store in dir, creating it if needed, and recover whatever the
+// snapshot and log hold
+func OpenDiskStore(dir string, sync SyncPolicy) (*DiskStore, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    d := &DiskStore{Dir: dir, Sync: sync, keys: make(map[Key]Siblings)}
+    if err := d.loadSnapshot(); err != nil {
+        return nil, err
+    }
+    if err := d.replay(); err != nil {
+        return nil, err
+    }
+    if sync == SyncBatch {
+        go d.syncProcess()
+    }
+    return d, nil
+}
+
+// The snapshot is a record for every key, in the same format as the log
+func (d *DiskStore) loadSnapshot() error {
+    f, err := os.Open(filepath.Join(d.Dir, snapshotName))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+    for {
+        record, _, err := readRecord(r)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        d.keys[record.Key] = record.siblings()
+    }
+}
+
+func (d *DiskStore) replay() error {
+    f, records, err := replayLog(filepath.Join(d.Dir, walName), func(record walRecord) {
+        if record.Removed {
+            delete(d.keys, record.Key)
+        } else {
+            d.keys[record.Key] = record.siblings()
+        }
+    })
+    d.wal = f
+    d.records = records
+    return err
+}
+
+// Apply every intact record in the log at filename and cut off the rest.
+// Returns the log opened for appending and how many records it has.
+func replayLog(filename string, apply func(walRecord)) (*os.File, int, error) {
+    f, err := os.OpenFile(filename, os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, 0, err
+    }
+    r := bufio.NewReader(f)
+    var good int64
+    records := 0
+    for {
+        record, size, err := readRecord(r)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            log.Println("write-ahead log ends in a bad record; dropping it:", err)
+            break
+        }
+        apply(record)
+        good += size
+        records++
+    }
+    if err = f.Truncate(good); err == nil {
+        _, err = f.Seek(good, 0)
+    }
+    if err != nil {
+        f.Close()
+        return nil, 0, err
+    }
+    return f, records, nil
+}
+
+func readRecord(r io.Reader) (walRecord, int64, error) {
+    var header struct {
+        Length uint32
+        Checksum uint32
+    }
+    var record walRecord
+    if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+        // io.EOF if the log ends cleanly here
+        return record, 0, err
+    }
+    payload := make([]byte, header.Length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return record, 0, io.ErrUnexpectedEOF
+    }
+    if crc32.ChecksumIEEE(payload) != header.Checksum {
+        return record, 0, errors.New("checksum mismatch")
+    }
+    if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+        return record, 0, err
+    }
+    return record, int64(8 + len(payload)), nil
+}
+
+func writeRecord(w io.Writer, record walRecord) error {
+    var payload bytes.Buffer
+    if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+        return err
+    }
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.BigEndian, uint32(payload.Len()))
+    binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+    buf.Write(payload.Bytes())
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+// Append a record to the log. A write that fails partway is cut off again,
+// since replay stops at a torn record and would lose every record after it.
+// Returns ErrLogDamaged if that fails too; nothing more can be appended then.
+func appendRecord(wal walFile, record walRecord) error {
+    offset, err := wal.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    writeErr := writeRecord(wal, record)
+    if writeErr == nil {
+        return nil
+    }
+    if err = wal.Truncate(offset); err == nil {
+        _, err = wal.Seek(offset, io.SeekStart)
+    }
+    if err != nil {
+        log.Println("could not cut a failed write off the write-ahead log:", err)
+        return ErrLogDamaged
+    }
+    return writeErr
+}
+
+func (d *DiskStore) append(record walRecord) error {
+    if d.closed {
+        return ErrStoreClosed
+    }
+    if d.damaged {
+        return ErrLogDamaged
+    }
+    if err := appendRecord(d.wal, record); err != nil {
+        d.damaged = err == ErrLogDamaged
+        return err
+    }
+    d.records++
+    d.dirty = true
+    if d.Sync == SyncAlways {
+        if err := d.wal.Sync(); err != nil {
+            return err
+        }
+        d.dirty = false
+    }
+    return nil
+}
+
+// Fold the log into a snapshot once it is long enough. Called after the
+// change just logged is in the map, so the snapshot has it.
+func (d *DiskStore) maybeSnapshot() {
+    if d.records >= SnapshotEvery {
+        if err := d.snapshot(); err != nil {
+            log.Println("could not snapshot the store:", err)
+        }
+    }
+}
+
+// Write every key to a new snapshot and start the log over. A crash before
+// the log is emptied just replays it over the snapshot again.
+func (d *DiskStore) snapshot() error {
+    name := filepath.Join(d.Dir, snapshotName)
+    tmpName := name + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    for k, siblings := range d.keys {
+        if err = writeRecord(w, newRecord(k, siblings)); err != nil {
+            break
+        }
+    }
+    if err == nil {
+        if err = w.Flush(); err == nil {
+            err = f.Sync()
+        }
+    }
+    f.Close()
+    if err != nil {
+        return err
+    }
+    if err = os.Rename(tmpName, name); err != nil {
+        return err
+    }
+    if dir, err := os.Open(d.Dir); err == nil {
+        dir.Sync()
+        dir.Close()
+    }
+
+    if err = d.wal.Truncate(0); err != nil {
+        return err
+    }
+    if _, err = d.wal.Seek(0, 0); err != nil {
+        return err
+    }
+    d.records = 0
+    d.dirty = false
+    d.damaged = false
+    return d.wal.Sync()
+}
+
+func (d *DiskStore) syncProcess() {
+    for {
+        time.Sleep(SyncInterval)
+        d.mutex.Lock()
+        if d.closed {
+            d.mutex.Unlock()
+            return
+        }
+        if d.dirty {
+            if err := d.wal.Sync(); err != nil {
+                log.Println("could not sync the write-ahead log:", err)
+            }
+            d.dirty = false
+        }
+        d.mutex.Unlock()
+    }
+}
+
+func (d *DiskStore) Get(k Key) Siblings {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    return d.keys[k]
+}
+
+func (d *DiskStore) Put(k Key, siblings Siblings) error {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if err := d.append(newRecord(k, siblings)); err != nil {
+        return err
+    }
+    d.keys[k] = siblings
+    d.maybeSnapshot()
+    return nil
+}
+
+func (d *DiskStore) Remove(k Key) error {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if _, ok := d.keys[k]; !ok {
+        return nil
+    }
+    if err := d.append(walRecord{Key: k, Removed: true}); err != nil {
+        return err
+    }
+    delete(d.keys, k)
+    d.maybeSnapshot()
+    return nil
+}
+
+func (d *DiskStore) Keys() []Key {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    keys := make([]Key, 0, len(d.keys))
+    for k := range d.keys {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+func (d *DiskStore) Len() int {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    return len(d.keys)
+}
+
+// Snapshot and close the log
+func (d *DiskStore) Close() error {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if d.closed {
+        return nil
+    }
+    err := d.snapshot()
+    d.closed = true
+    if closeErr := d.wal.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
@@ -0,0 +1,179 @@
+package mykv
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func tempStore(t *testing.T, sync SyncPolicy) (*DiskStore, string) {
+    dir, err := ioutil.TempDir("", "diskstore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    d, err := OpenDiskStore(dir, sync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return d, dir
+}
+
+func value(v string) Siblings {
+    return Siblings{{Key: 1, Version: VersionVector{"a": 1}, Value: v}}
+}
+
+func TestDiskStoreRecoversLog(t *testing.T) {
+    d, dir := tempStore(t, SyncAlways)
+    defer os.RemoveAll(dir)
+    d.Put(1, value("one"))
+    d.Put(2, value("two"))
+    d.Put(2, value("two again"))
+    d.Remove(1)
+
+    // Reopen without closing, as after a crash
+    d, err := OpenDiskStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d.Len() != 1 || d.Get(2)[0].Value != "two again" {
+        t.Error("recovered", d.Keys(), d.Get(2))
+    }
+}
+
+func TestDiskStoreDropsTornRecord(t *testing.T) {
+    d, dir := tempStore(t, SyncAlways)
+    defer os.RemoveAll(dir)
+    d.Put(1, value("one"))
+    d.Put(2, value("two"))
+
+    // Cut the last record short, as if we crashed while writing it
+    wal := filepath.Join(dir, walName)
+    info, _ := os.Stat(wal)
+    os.Truncate(wal, info.Size() - 3)
+
+    d, err := OpenDiskStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d.Len() != 1 || d.Get(1)[0].Value != "one" {
+        t.Fatal("recovered", d.Keys())
+    }
+
+    // New records go after the last good one
+    d.Put(3, value("three"))
+    d, err = OpenDiskStore(dir, SyncAlways)
+    if err != nil || d.Len() != 2 || d.Get(3)[0].Value != "three" {
+        t.Error("after a torn record, recovered", d.Keys(), err)
+    }
+}
+
+// A log whose writes get halfway and fail while fail is set, and which can't
+// be truncated while noTruncate is
+type failingLog struct {
+    *os.File
+    fail bool
+    noTruncate bool
+}
+
+func (f *failingLog) Write(p []byte) (int, error) {
+    if !f.fail {
+        return f.File.Write(p)
+    }
+    n, _ := f.File.Write(p[:len(p) / 2])
+    return n, errors.New("disk full")
+}
+
+func (f *failingLog) Truncate(size int64) error {
+    if f.noTruncate {
+        return errors.New("read-only file system")
+    }
+    return f.File.Truncate(size)
+}
+
+func TestDiskStoreCutsOffFailedWrite(t *testing.T) {
+    d, dir := tempStore(t, SyncAlways)
+    defer os.RemoveAll(dir)
+    wal := &failingLog{File: d.wal.(*os.File)}
+    d.wal = wal
+    d.Put(1, value("one"))
+    wal.fail = true
+    if err := d.Put(2, value("two")); err == nil {
+        t.Fatal("failed write returned no error")
+    }
+    wal.fail = false
+    if err := d.Put(3, value("three")); err != nil {
+        t.Fatal(err)
+    }
+
+    // The write after the failed one is not hidden behind a torn record
+    recovered, err := OpenDiskStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if recovered.Len() != 2 || recovered.Get(3) == nil {
+        t.Error("recovered", recovered.Keys())
+    }
+
+    // If the torn record can't be cut off, nothing more is written after it
+    wal.fail, wal.noTruncate = true, true
+    if err := d.Put(4, value("four")); err != ErrLogDamaged {
+        t.Fatal("write that could not be cut off returned", err)
+    }
+    wal.fail, wal.noTruncate = false, false
+    if err := d.Put(5, value("five")); err != ErrLogDamaged {
+        t.Error("write to a damaged log returned", err)
+    }
+}
+
+func TestDiskStoreSnapshots(t *testing.T) {
+    d, dir := tempStore(t, SyncNever)
+    defer os.RemoveAll(dir)
+    for k := Key(0); k < SnapshotEvery + 10; k++ {
+        d.Put(k, value("v"))
+    }
+    if d.records != 10 {
+        t.Error("log has", d.records, "records after a snapshot")
+    }
+    tombstone := Siblings{{Key: 5, Version: VersionVector{"a": 2}, Deleted: true, deletedAt: 1234}}
+    d.Put(5, tombstone)
+    if err := d.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    d, err := OpenDiskStore(dir, SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d.Len() != SnapshotEvery + 10 {
+        t.Error("recovered", d.Len(), "keys")
+    }
+    // Tombstones carry on with their grace period
+    if s := d.Get(5); len(s) != 1 || !s[0].Deleted || s[0].deletedAt != 1234 {
+        t.Error("recovered tombstone as", s)
+    }
+}
+
+func TestNodeOnDiskStore(t *testing.T) {
+    d, dir := tempStore(t, SyncAlways)
+    defer os.RemoveAll(dir)
+    node := NewNodeWithStore(0, d)
+    node.Name = "a"
+    var stored KeyValue
+    node.Put(&KeyValue{Key: 4, Value: "x"}, &stored)
+
+    d, _ = OpenDiskStore(dir, SyncAlways)
+    node = NewNodeWithStore(0, d)
+    node.Name = "a"
+    var siblings Siblings
+    if err := node.Lookup(&stored.Key, &siblings); err != nil || siblings[0].Value != "x" {
+        t.Fatal("restarted node has", siblings, err)
+    }
+
+    // The restarted node keeps counting its writes where it left off
+    node.Put(&KeyValue{Key: 4, Value: "y"}, &stored)
+    if stored.Version["a"] != 2 {
+        t.Error("write after restart got version", stored.Version)
+    }
+}
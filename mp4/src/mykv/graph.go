@@ -5,17 +5,25 @@ import (
     "sort"
     "time"
     "errors"
-    "math/rand"
+    "net/rpc"
+    "sync"
+    "sync/atomic"
 
     "membertable"
 )
 
 const numberOfReplicas = int(3)
 
+// How long a replica gets to answer one call, connecting included, unless
+// the graph sets its own Timeout
+const RPCTimeout = 2 * time.Second
+
 type ConstLvl int
 
 var (
     ErrConstNotMet = errors.New("key unavailable")
+    ErrMinorityPartition = errors.New("refusing write: in a minority partition")
+    ErrTimeout = errors.New("replica did not answer in time")
 )
 
 const (
@@ -39,22 +47,101 @@ func (g *KVGraph) numRequired(c ConstLvl) int {
         numRequired = numberOfReplicas
     }
 
-    if numRequired > len(g.NodeIndex){
-        numRequired = len(g.NodeIndex)
+    if nodes := g.numNodes(); numRequired > nodes {
+        numRequired = nodes
     }
 
     return numRequired
 }
 
+// Tallies replica answers to one request against a consistency level.
+// Every operation decides success the same way: once enough replicas have
+// acknowledged it.
+type quorum struct {
+    required int
+    acks int
+    // replicas that answered that they don't have the key
+    missing int
+    failed int
+}
+
+func (g *KVGraph) newQuorum(c ConstLvl) *quorum {
+    return &quorum{required: g.numRequired(c)}
+}
+
+// Whether err is a replica saying it does not have the key. Errors that
+// come back over RPC lose their identity, so the text is compared.
+func isNoKey(err error) bool {
+    return err != nil && err.Error() == ErrNoKey.Error()
+}
+
+func (q *quorum) ack() {
+    q.acks++
+}
+
+// Count a replica's answer that was not an ack
+func (q *quorum) fail(err error) {
+    if isNoKey(err) {
+        q.missing++
+    } else {
+        q.failed++
+    }
+}
+
+func (q *quorum) met() bool {
+    return q.acks >= q.required
+}
+
+// nil once the level is met. Otherwise ErrNoKey if enough replicas to meet it
+// said they don't have the key, and ErrConstNotMet if too few answered.
+func (q *quorum) err() error {
+    switch {
+        case q.met(): return nil
+        case q.missing >= q.required: return ErrNoKey
+    }
+    return ErrConstNotMet
+}
+
+// One token of a member on the ring. A member has many vertices, all with the
+// same Addr.
 type Vertex struct {
     Addr string
     Hash HashedKey
+    Rack string
     LocalNode *KVNode
 }
 
 type KVGraph struct {
     NodeIndex []*Vertex
     Connector RPCConnector
+    // reports whether the membership we are using is cut off from most of the
+    // cluster; Quorum and All writes are refused while it is true
+    Minority func() bool
+    // the version of the committed ring NodeIndex was built from, or zero if
+    // it came straight from the membertable
+    RingVersion int64
+
+    // how conflicting versions are settled when reads are merged; has to
+    // match the policy of the nodes
+    Policy ConflictPolicy
+    // how long a replica gets to answer one call; RPCTimeout if zero
+    Timeout time.Duration
+
+    // every member as we last saw it in the ring, tokens and rack, so the
+    // keys of a member that left can be found after it is gone
+    lastSeen map[membertable.ID]RingMember
+    lastSeenMutex sync.Mutex
+    // bumped every time NodeIndex is replaced
+    ringChanges int64
+}
+
+// The number of physical nodes in the ring
+func (g *KVGraph) numNodes() int {
+    addrs := make(map[string]bool)
+    for _, v := range g.NodeIndex {
+        addrs[v.Addr] = true
+    }
+    return len(addrs)
 }
 
 func (g *KVGraph) Len() int {
@@ -72,40 +159,113 @@ func (g *KVGraph) Swap(i, j int) {
 }
 
 
-func (g *KVGraph) Seed(seedAddr string) error {
-    client, err := g.Connector.Connect(seedAddr)
+// Load the ring from the first of the comma separated seed addresses that
+// answers
+func (g *KVGraph) Seed(seedAddrs string) error {
+    err := error(membertable.ErrNoSeeds)
+    var client *rpc.Client
+    var seed string
+    for _, seed = range membertable.ParseSeeds(seedAddrs) {
+        if client, err = g.Connector.Connect(seed); err == nil {
+            break
+        }
+    }
     if err != nil {
         return err
     }
-    defer client.Close()
+    defer func() { g.Connector.Release(seed, client, err) }()
     var dummy int
-    var members []membertable.Member
-    client.Call("Table.RPCGetActiveMembers", dummy, &members)
-    g.SetByMembertable(members)
+    var ring Ring
+    if err = client.Call("RingLog.RPCGetRing", dummy, &ring); err == nil && len(ring.Members) > 0 {
+        g.SetByRing(ring)
+    } else {
+        var members []membertable.Member
+        client.Call("Table.RPCGetActiveMembersWithRole", membertable.RoleKV, &members)
+        g.SetByMembertable(members)
+    }
+
+    var status membertable.PartitionStatus
+    if err = client.Call("Table.RPCGetPartitionStatus", dummy, &status); err == nil {
+        g.Minority = func() bool { return status.Minority }
+    }
+    return nil
+}
+
+// Writes that need more than one replica are not allowed while in a minority
+// partition, since the other side may be accepting conflicting writes
+func (g *KVGraph) checkWrite(c ConstLvl) error {
+    if c != One && g.Minority != nil && g.Minority() {
+        return ErrMinorityPartition
+    }
     return nil
 }
 
 func (g *KVGraph) SetByMembertable(members []membertable.Member)  {
-    g.NodeIndex = make([]*Vertex, 0, len(members))
-    for _, member := range members {
+    g.setByMembers(RingMembers(members))
+    g.RingVersion = 0
+}
 
-        v := &Vertex{
-            Addr: member.ID.Address,
-            Hash: HashedKey(member.ID.Hashed()),
-            LocalNode: nil,
+// Use a ring committed through raft, so every node places keys the same way
+func (g *KVGraph) SetByRing(ring Ring) {
+    g.setByMembers(ring.Members)
+    g.RingVersion = ring.Version
+}
+
+// The vertices for every token of the given members, in no particular order
+func memberVerticies(members []RingMember) []*Vertex {
+    var verts []*Vertex
+    for _, member := range members {
+        tokens := member.Tokens
+        if tokens < 1 {
+            tokens = 1
+        }
+        for i := 0; i < tokens; i++ {
+            v := &Vertex{
+                Addr: member.ID.Address,
+                Hash: tokenHash(member.ID, i),
+                Rack: member.Rack,
+                LocalNode: nil,
+            }
+            verts = append(verts, v)
         }
-        g.NodeIndex = append(g.NodeIndex, v)
     }
+    return verts
+}
+
+func (g *KVGraph) setByMembers(members []RingMember) {
+    g.lastSeenMutex.Lock()
+    if g.lastSeen == nil {
+        g.lastSeen = make(map[membertable.ID]RingMember)
+    }
+    for _, member := range members {
+        g.lastSeen[member.ID] = member
+    }
+    g.lastSeenMutex.Unlock()
+
+    g.setRing(memberVerticies(members))
+}
+
+// Use verts as the ring. They are sorted here, once, so lookups can search
+// them without checking.
+func (g *KVGraph) setRing(verts []*Vertex) {
+    g.NodeIndex = verts
     sort.Sort(g)
+    atomic.AddInt64(&g.ringChanges, 1)
+}
+
+// How many times the ring has changed, so callers can tell whether what
+// they worked out from it is still good
+func (g *KVGraph) ringChangeCount() int64 {
+    return atomic.LoadInt64(&g.ringChanges)
 }
 
-func (g *KVGraph) FindNode(k HashedKey) *Vertex {
+// Serve every vertex of the node at addr from the given local node
+func (g *KVGraph) SetLocalNode(addr string, node *KVNode) {
     for _, v := range g.NodeIndex {
-        if v.Hash == k {
-            return v
+        if v.Addr == addr {
+            v.LocalNode = node
         }
     }
-    return nil
 }
 
 func (g *KVGraph) FindVerticies(k Key) []*Vertex {
@@ -113,143 +273,354 @@ func (g *KVGraph) FindVerticies(k Key) []*Vertex {
 }
 
 
+// Write kv as a new version of its key. kv.Version should be the Context of
+// the siblings the client read, or nil for a blind write that does not
+// supersede anything.
 func (g *KVGraph) Insert(kv KeyValue, c ConstLvl) error {
-    // TODO change for quarrum
+    return g.write("KVNode.Put", kv, c)
+}
+
+// Same as Insert, but only for a key that exists. Fails with ErrNoKey if
+// enough replicas to meet c say they don't have it.
+func (g *KVGraph) Update(kv KeyValue, c ConstLvl) error {
+    return g.write("KVNode.Update", kv, c)
+}
+
+// The first replica that takes the write gives it a version, and that
+// version is sent on to the rest. For an Update the coordinator must already
+// have the key; if no replica does, the write fails with ErrNoKey.
+//
+// Finding a coordinator gets one timeout in all. Each replica tried gets an
+// even share of what is left, so a hung one doesn't use up the time for the
+// rest. They are tried one at a time, since each would version the write.
+func (g *KVGraph) write(method string, kv KeyValue, c ConstLvl) error {
+    if err := g.checkWrite(c); err != nil {
+        return err
+    }
     verts := g.FindVerticies(kv.Key)
-    err := error(nil)
-    succes := 0
-    required := g.numRequired(c)
-    for _, v := range verts {
-        currentErr := g.insertToVert(kv, v)
-        if currentErr != nil {
-            err = currentErr
+    q := g.newQuorum(c)
+    coordinator := -1
+    deadline := time.Now().Add(g.timeout())
+    for i, v := range verts {
+        share := time.Until(deadline) / time.Duration(len(verts) - i)
+        var stored KeyValue
+        if err := g.callVertexWithin(v, method, &kv, &stored, share); err != nil {
+            q.fail(err)
+            continue
+        }
+        kv = stored
+        coordinator = i
+        q.ack()
+        break
+    }
+    if coordinator < 0 {
+        return q.err()
+    }
+
+    // Replicas that said they lacked the key get the new version too
+    var rest []*Vertex
+    for i, v := range verts {
+        if i != coordinator {
+            rest = append(rest, v)
+        }
+    }
+    responses := g.fanOut(rest, "KVNode.Insert", &kv, func() interface{} { return new(bool) })
+    pending := len(rest)
+    for ; pending > 0 && !q.met(); pending-- {
+        if r := <-responses; r.err != nil {
+            q.fail(r.err)
+            g.hintFailed(r, kv)
         } else {
-            succes++
+            q.ack()
         }
-        if succes >= required {
-            return err
+    }
+
+    // The rest finish in the background, and replicas they can't reach get
+    // a hint
+    go func() {
+        for ; pending > 0; pending-- {
+            g.hintFailed(<-responses, kv)
         }
+    }()
+    return q.err()
+}
+
+// Whether a call failed without the replica answering: it could not be
+// reached, its connection broke or it did not answer in time
+func unreachable(err error) bool {
+    _, fromServer := err.(rpc.ServerError)
+    return err != nil && !fromServer
+}
+
+// Leave a hint for a replica a write could not reach. Replicas that answered
+// with an error of their own are not down, so they get no hint.
+func (g *KVGraph) hintFailed(r response, kv KeyValue) {
+    if !unreachable(r.err) {
+        return
     }
-    return err
+    hint := Hint{Addr: r.vertex.Addr, KeyValue: kv}
+    // We hold it if we are a node; otherwise the next node on the ring past
+    // the replicas does
+    if local := g.findLocalNode(); local != nil && local.LocalNode.Hints != nil {
+        local.LocalNode.Hints.Add(hint)
+        return
+    }
+    for _, v := range g.hintHolders(kv.Key) {
+        var reply bool
+        if err := g.callVertex(v, "KVNode.Hint", &hint, &reply); err == nil {
+            return
+        }
+    }
+    log.Println("no node could take a hint for", r.vertex.Addr)
 }
 
-func (g *KVGraph) InsertLocal(kv KeyValue) {
-    v := g.findLocalNode()
-    if v.LocalNode != nil {
-        v.LocalNode.KeyValues[kv.Key] = kv
+// The nodes after a key's replicas on the ring, in order, one vertex each
+func (g *KVGraph) hintHolders(k Key) []*Vertex {
+    replicas := make(map[string]bool)
+    for _, v := range g.FindVerticies(k) {
+        replicas[v.Addr] = true
+    }
+    start := sort.Search(len(g.NodeIndex), func(i int) bool {
+        return g.NodeIndex[i].Hash >= k.Hashed()
+    })
+    var holders []*Vertex
+    for i := 0; i < len(g.NodeIndex); i++ {
+        v := g.NodeIndex[(start + i) % len(g.NodeIndex)]
+        if !replicas[v.Addr] {
+            replicas[v.Addr] = true
+            holders = append(holders, v)
+        }
     }
+    return holders
 }
 
-func (g *KVGraph) insertToVert(kv KeyValue, v *Vertex) error {
-    remoteNode, err := g.Connector.Connect(v.Addr)
-    if err != nil {
-        return err
+// Hand the hints we hold for the members to them, now that they are back.
+// Hints that still can't be delivered are held again.
+func (g *KVGraph) ReplayHints(members []membertable.ID) {
+    for _, id := range members {
+        g.replayHints(id.Address)
     }
-    defer remoteNode.Close()
+}
 
-    var reply bool
-    err = remoteNode.Call("KVNode.Insert", &kv, &reply)
-    if err != nil {
-        return err
+func (g *KVGraph) replayHints(addr string) {
+    local := g.findLocalNode()
+    if local == nil || local.LocalNode.Hints == nil {
+        return
+    }
+    hints := local.LocalNode.Hints.Take(addr)
+    for i, hint := range hints {
+        if err := g.insertToVert(hint.KeyValue, &Vertex{Addr: addr}); err != nil {
+            // keep the rest for next time, with the times they were taken
+            for _, h := range hints[i:] {
+                local.LocalNode.Hints.Add(h)
+            }
+            return
+        }
+    }
+    if len(hints) > 0 {
+        log.Println("handed", len(hints), "hints to", addr)
     }
-    return nil
 }
 
-func (g *KVGraph) Update(kv KeyValue, c ConstLvl) error {
-    // TODO change for quarrum
+// Retry the hints we hold every HintInterval
+func (g *KVGraph) HintProcess() {
+    for {
+        time.Sleep(HintInterval)
+        local := g.findLocalNode()
+        if local == nil || local.LocalNode.Hints == nil {
+            continue
+        }
+        for _, addr := range local.LocalNode.Hints.Addrs() {
+            g.replayHints(addr)
+        }
+    }
+}
+
+// Store a version on the local node without going over the network
+func (g *KVGraph) InsertLocal(kv KeyValue) {
+    v := g.findLocalNode()
+    if v.LocalNode != nil {
+        var stored KeyValue
+        v.LocalNode.Put(&kv, &stored)
+    }
+}
+
+// Send an already versioned value to every replica of its key
+func (g *KVGraph) replicate(kv KeyValue) error {
     verts := g.FindVerticies(kv.Key)
+    responses := g.fanOut(verts, "KVNode.Insert", &kv, func() interface{} { return new(bool) })
     err := error(nil)
-    for _, v := range verts {
-        currentErr := g.insertToVert(kv, v)
-        if currentErr != nil {
-            err = currentErr
+    for _ = range verts {
+        if r := <-responses; r.err != nil {
+            err = r.err
         }
     }
     return err
 }
 
-func (g *KVGraph) updateVertex(kv KeyValue, v *Vertex) error {
-    remoteNode, err := g.Connector.Connect(v.Addr)
-    if err != nil {
-        return err
+// One replica's answer to a call made with fanOut
+type response struct {
+    vertex *Vertex
+    reply interface{}
+    err error
+}
+
+// Call method on every vertex at once, each with a fresh reply from
+// newReply. Answers come back in the order they arrive; the channel has room
+// for all of them, so the caller can stop reading once it has enough.
+func (g *KVGraph) fanOut(verts []*Vertex, method string, args interface{}, newReply func() interface{}) <-chan response {
+    responses := make(chan response, len(verts))
+    for _, v := range verts {
+        go func(v *Vertex) {
+            reply := newReply()
+            err := g.callVertex(v, method, args, reply)
+            responses <- response{v, reply, err}
+        }(v)
     }
-    defer remoteNode.Close()
+    return responses
+}
 
-    var reply bool
-    err = remoteNode.Call("KVNode.Update", &kv, &reply)
-    if err != nil {
-        return err
+// Call method on v's node, giving up after the timeout. The reply must not be
+// read if this fails, since a call that timed out may still be writing it.
+func (g *KVGraph) callVertex(v *Vertex, method string, args interface{}, reply interface{}) error {
+    return g.callVertexWithin(v, method, args, reply, g.timeout())
+}
+
+func (g *KVGraph) timeout() time.Duration {
+    if g.Timeout == 0 {
+        return RPCTimeout
     }
-    return nil
+    return g.Timeout
 }
 
-func (g *KVGraph) Lookup(k Key, c ConstLvl) (*KeyValue, error) {
-    verts := g.FindVerticies(k)
-    var newestData *KeyValue
-    newestData = nil
-    var err error
-    succes := int(0)
-    for _, v := range verts{
-        data, currentErr := g.lookupVertex(k, v)
-        if currentErr == nil {
-            succes++
-            if newestData == nil || newestData.Time < data.Time {
-                newestData = data
-            }
+// Same as callVertex, with a timeout of its own
+func (g *KVGraph) callVertexWithin(v *Vertex, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+    deadline := time.After(timeout)
+    for attempt := 0; ; attempt++ {
+        err := g.callVertexBy(v, method, args, reply, deadline)
+        // a shared client that was already shut down never sent the call,
+        // so it is safe to try again on a new one
+        if err != rpc.ErrShutdown || attempt > 0 {
+            return err
         }
     }
+}
 
-    // read repair
-    if newestData != nil {
-        g.Insert(*newestData, All)
-    }
-    if succes >= g.numRequired(c) {
-        return newestData, err
-    } else {
-        return nil, ErrConstNotMet
+func (g *KVGraph) callVertexBy(v *Vertex, method string, args interface{}, reply interface{}, deadline <-chan time.Time) error {
+    type connection struct {
+        client *rpc.Client
+        err error
+    }
+    connected := make(chan connection, 1)
+    go func() {
+        client, err := g.Connector.Connect(v.Addr)
+        connected <- connection{client, err}
+    }()
+
+    var remoteNode *rpc.Client
+    select {
+        case c := <-connected:
+            if c.err != nil {
+                return c.err
+            }
+            remoteNode = c.client
+        case <-deadline:
+            // hand the connection back if it ever opens
+            go func() {
+                if c := <-connected; c.err == nil {
+                    g.Connector.Release(v.Addr, c.client, nil)
+                }
+            }()
+            return ErrTimeout
+    }
+
+    // A call that times out is abandoned, not cancelled, since the client
+    // may be shared with other calls to the same node
+    call := remoteNode.Go(method, args, reply, make(chan *rpc.Call, 1))
+    var err error
+    select {
+        case <-call.Done:
+            err = call.Error
+        case <-deadline:
+            err = ErrTimeout
     }
+    g.Connector.Release(v.Addr, remoteNode, err)
+    return err
 }
 
-func (g *KVGraph) lookupVertex(k Key, v *Vertex) (*KeyValue, error) {
-    remoteNode, err := g.Connector.Connect(v.Addr)
-    if err != nil {
-        return nil, err
+func (g *KVGraph) insertToVert(kv KeyValue, v *Vertex) error {
+    var reply bool
+    return g.callVertex(v, "KVNode.Insert", &kv, &reply)
+}
+
+// Every version of the key that no other version descends from. More than
+// one means the key was written concurrently; the client should pick or
+// combine them and Insert the result with the siblings' Context. Returns no
+// siblings if no replica has the key.
+//
+// Every replica is asked at once and the lookup returns as soon as c is met.
+// The answers still out are collected in the background, and once all are in
+// any replica that was missing a version is repaired.
+func (g *KVGraph) Lookup(k Key, c ConstLvl) (Siblings, error) {
+    verts := g.FindVerticies(k)
+    responses := g.fanOut(verts, "KVNode.Lookup", &k, func() interface{} { return new(Siblings) })
+    q := g.newQuorum(c)
+    var answers []response
+    var merged Siblings
+    for len(answers) < len(verts) && !q.met() {
+        r := <-responses
+        answers = append(answers, r)
+        // a replica without the key still answered
+        if r.err == nil || isNoKey(r.err) {
+            q.ack()
+            merged = mergeSiblings(merged, *r.reply.(*Siblings), g.Policy)
+        } else {
+            q.fail(r.err)
+        }
     }
-    defer remoteNode.Close()
 
-    var kv KeyValue
-    err = remoteNode.Call("KVNode.Lookup", &k, &kv)
-    if err != nil {
+    go g.readRepair(k, answers, responses, len(verts) - len(answers))
+    if err := q.err(); err != nil {
         return nil, err
     }
-    return &kv, nil
+    return append(Siblings(nil), merged...), nil
 }
 
-func (g *KVGraph) Delete(k Key, c ConstLvl) error {
-    verts := g.FindVerticies(k)
-    err := error(nil)
-    for _, v := range verts {
-        currentErr := g.deleteFromVertex(k, v)
-        if currentErr != nil {
-            err = currentErr
+// Wait for the pending answers to a lookup, then send every replica that
+// answered the versions it was missing. Replicas that did not answer are
+// left to anti-entropy.
+func (g *KVGraph) readRepair(k Key, answers []response, responses <-chan response, pending int) {
+    for ; pending > 0; pending-- {
+        answers = append(answers, <-responses)
+    }
+    var merged Siblings
+    for _, r := range answers {
+        if r.err == nil {
+            merged = mergeSiblings(merged, *r.reply.(*Siblings), g.Policy)
         }
     }
-    return err
-}
-
-func (g *KVGraph) deleteFromVertex(k Key, v *Vertex) error {
-    remoteNode, err := g.Connector.Connect(v.Addr)
-    if err != nil {
-        return err
+    for _, r := range answers {
+        if r.err != nil && !isNoKey(r.err) {
+            continue
+        }
+        var had Siblings
+        if r.err == nil {
+            had = *r.reply.(*Siblings)
+        }
+        for _, kv := range merged {
+            if _, news := mergeSibling(had, kv, g.Policy); news {
+                if err := g.insertToVert(kv, r.vertex); err != nil {
+                    log.Println("read repair of", k, "on", r.vertex.Addr, "failed:", err)
+                }
+            }
+        }
     }
-    defer remoteNode.Close()
+}
 
-    var reply bool
-    err = remoteNode.Call("KVNode.Delete", &k, &reply)
-    if err != nil {
-        return err
-    }
-    return nil
+// Delete a key by writing a tombstone over it. Older values that turn up
+// later lose to the tombstone, so repair does not bring them back.
+func (g *KVGraph) Delete(k Key, c ConstLvl) error {
+    return g.write("KVNode.Delete", KeyValue{Key: k, Time: StampNow()}, c)
 }
 
 func (g *KVGraph) circularIndex(idx int) *Vertex {
@@ -262,18 +633,39 @@ func (g *KVGraph) circularIndex(idx int) *Vertex {
     return g.NodeIndex[idx]
 }
 
+// The vertices that hold a key: the first one at or after the key's hash and
+// the ones after it, one per physical node, skipping nodes in a rack that
+// already has a replica for as long as there are other racks left. verts
+// must be sorted by hash.
 func verticiesHave(k Key, verts []*Vertex) []*Vertex {
     hashedKey := k.Hashed()
     verticies := make([]*Vertex, 0, numberOfReplicas)
-    if len(verts) <= numberOfReplicas {
-        verticies = append(verticies, verts...)
-        return verticies
+
+    start := sort.Search(len(verts), func(i int) bool {
+        return verts[i].Hash >= hashedKey
+    })
+
+    nodes := make(map[string]bool)
+    racks := make(map[string]bool)
+    var skipped []*Vertex
+    for i := 0; i < len(verts) && len(verticies) < numberOfReplicas; i++ {
+        v := verts[loop(start + i, len(verts))]
+        if nodes[v.Addr] {
+            continue
+        }
+        nodes[v.Addr] = true
+        if racks[v.Rack] {
+            skipped = append(skipped, v)
+            continue
+        }
+        racks[v.Rack] = true
+        verticies = append(verticies, v)
     }
-    for i, v := range verts {
-        prevHash := verts[loop(i - numberOfReplicas, len(verts))].Hash
-        if hashInRange(prevHash, v.Hash, hashedKey) {
-            verticies = append(verticies, v)
+    for _, v := range skipped {
+        if len(verticies) >= numberOfReplicas {
+            break
         }
+        verticies = append(verticies, v)
     }
     return verticies
 }
@@ -285,10 +677,11 @@ func loop(index, length int) int {
     return length + (index % length)
 }
 
-func shouldHave(k Key, verts []*Vertex, h HashedKey) bool {
+// Whether the node at addr is one of the replicas of k
+func shouldHave(k Key, verts []*Vertex, addr string) bool {
     candidates := verticiesHave(k, verts)
     for _, vert := range candidates {
-        if vert.Hash == h {
+        if vert.Addr == addr {
             return true
         }
     }
@@ -313,73 +706,71 @@ func (g *KVGraph) HandleStaleKeys(changedMembers []membertable.ID, dropped bool)
     if me == nil {
         return
     }
-    verts := make([]*Vertex, 0, 10)
-    verts = append(verts, g.NodeIndex...)
+    verts := g.NodeIndex
     if dropped {
-        for _, id := range changedMembers {
-            newVertex := Vertex{ Addr: "nowhere",
-                                 Hash : HashedKey(id.Hashed()),
-                                 LocalNode : nil }
-            verts = append(verts, &newVertex)
-        }
+        verts = g.ringWith(changedMembers)
     }
     for _, id := range changedMembers {
-        for k, keyValue := range me.LocalNode.KeyValues {
-            if shouldHave(k, verts, HashedKey(id.Hashed())) {
-                g.Insert(keyValue, All)
+        for _, k := range me.LocalNode.Keys() {
+            if shouldHave(k, verts, id.Address) {
+                for _, keyValue := range me.LocalNode.Siblings(k) {
+                    g.replicate(keyValue)
+                }
             }
-            if !shouldHave(k, verts, me.LocalNode.maxHashedKey) && !dropped {
-                var success bool
-                me.LocalNode.Delete(&k, &success)
+            if !shouldHave(k, verts, me.Addr) && !dropped {
+                me.LocalNode.Forget(k)
             }
         }
     }
 }
 
-func (g *KVGraph) RandomRepair() {
-    local := g.findLocalNode()
-    if local == nil {
-        return
-    }
-    if len(local.LocalNode.KeyValues) == 0 {
-        return
-    }
-    index := rand.Int() % len(local.LocalNode.KeyValues)
-    i := 0
-    for _, kv := range(local.LocalNode.KeyValues) {
-        if i == index {
-            g.Insert(kv, All)
-            return
+// The ring with the given dropped members put back where they were, so we
+// can tell which keys they held. Their tokens spread over the whole ring, so
+// the keys get rebalanced onto every node instead of one neighbour, and their
+// racks decide which replicas the other keys skipped.
+func (g *KVGraph) ringWith(dropped []membertable.ID) []*Vertex {
+    var ring []RingMember
+    g.lastSeenMutex.Lock()
+    for _, id := range dropped {
+        member, ok := g.lastSeen[id]
+        if !ok {
+            // never saw it; guess the default
+            member = RingMember{ID: id, Tokens: TokensPerWeight}
         }
-        i++
+        ring = append(ring, member)
     }
-}
+    g.lastSeenMutex.Unlock()
 
-func (g *KVGraph) RandomRepairProcess() {
-    for {
-        g.RandomRepair()
-        time.Sleep(100 * time.Millisecond)
-    }
+    verts := append(append([]*Vertex(nil), g.NodeIndex...), memberVerticies(ring)...)
+    sort.Slice(verts, func(i, j int) bool {
+        return verts[i].Hash < verts[j].Hash
+    })
+    return verts
 }
 
 func (g *KVGraph) RemoveLocalNodes() {
     // Sort nodes into local and non-local
     var filteredNodeIndex []*Vertex
     var localNodes []*KVNode
+    seen := make(map[*KVNode]bool)
     for _, v := range g.NodeIndex {
         if v.LocalNode == nil {
             filteredNodeIndex = append(filteredNodeIndex, v)
-        } else {
+        } else if !seen[v.LocalNode] {
+            // every token of the node points at it
+            seen[v.LocalNode] = true
             localNodes = append(localNodes, v.LocalNode)
         }
     }
 
     // Set the node index to be only remote nodes and redistribute the keys
-    g.NodeIndex = filteredNodeIndex
+    g.setRing(filteredNodeIndex)
     for _, node := range localNodes {
-        for _, keyValue := range node.KeyValues {
-            if err := g.Insert(keyValue, All); err != nil {
-                log.Printf("redis error: %v", err)
+        for _, k := range node.Keys() {
+            for _, keyValue := range node.Siblings(k) {
+                if err := g.replicate(keyValue); err != nil {
+                    log.Printf("redis error: %v", err)
+                }
             }
         }
     }
@@ -0,0 +1,452 @@
+package mykv
+
+import (
+    "errors"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "net/rpc"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    "membertable"
+)
+
+// Vertices spread evenly around the ring, one node per rack given
+func evenRing(racks ...string) []*Vertex {
+    step := HashedKey(0xFFFFFFFF / uint32(len(racks)))
+    var verts []*Vertex
+    for i, rack := range racks {
+        verts = append(verts, &Vertex{Addr: strconv.Itoa(i), Hash: step * HashedKey(i + 1), Rack: rack})
+    }
+    return verts
+}
+
+func ringOf(weights ...string) []RingMember {
+    var members []membertable.Member
+    for i, weight := range weights {
+        mem := membertable.Member{ID: membertable.ID{Num: membertable.IDNum(i), Address: "host" + strconv.Itoa(i)}}
+        if weight != "" {
+            mem.Meta.Tags = map[string]string{membertable.TagWeight: weight}
+        }
+        members = append(members, mem)
+    }
+    return RingMembers(members)
+}
+
+// How many of the keys each node is the first replica of. Sequential keys
+// hash close together, so random ones are used.
+func ownership(g *KVGraph, keys int) map[string]int {
+    r := rand.New(rand.NewSource(1))
+    owned := make(map[string]int)
+    for i := 0; i < keys; i++ {
+        owned[g.FindVerticies(Key(r.Uint32()))[0].Addr]++
+    }
+    return owned
+}
+
+func TestReplicasSpreadOverRacks(t *testing.T) {
+    // Two racks with three vertices each, next to each other on the ring
+    verts := evenRing("a", "a", "a", "b", "b", "b")
+    for k := Key(0); k < 500; k++ {
+        have := verticiesHave(k, verts)
+        if len(have) != numberOfReplicas {
+            t.Fatalf("key %v has %v replicas", k, len(have))
+        }
+        racks := make(map[string]bool)
+        for _, v := range have {
+            racks[v.Rack] = true
+        }
+        if len(racks) != 2 {
+            t.Fatalf("key %v only has replicas in racks %v", k, racks)
+        }
+    }
+}
+
+func TestReplicasWithoutRacks(t *testing.T) {
+    // Without racks the replicas are the owner and the two after it
+    verts := evenRing("", "", "", "", "", "")
+    for k := Key(0); k < 500; k++ {
+        owner := 0
+        for owner < len(verts) && verts[owner].Hash < k.Hashed() {
+            owner++
+        }
+        have := verticiesHave(k, verts)
+        for i, v := range have {
+            if v != verts[(owner + i) % len(verts)] {
+                t.Fatalf("replica %v of key %v is %v, want %v", i, k, v.Hash, verts[(owner + i) % len(verts)].Hash)
+            }
+        }
+    }
+}
+
+func TestReplicasOnDistinctNodes(t *testing.T) {
+    var g KVGraph
+    g.SetByRing(Ring{1, ringOf("", "", "", "", "")})
+    if len(g.NodeIndex) != 5 * TokensPerWeight {
+        t.Fatal("ring has", len(g.NodeIndex), "vertices")
+    }
+    for k := Key(0); k < 1000; k++ {
+        have := g.FindVerticies(k)
+        nodes := make(map[string]bool)
+        for _, v := range have {
+            nodes[v.Addr] = true
+        }
+        if len(have) != numberOfReplicas || len(nodes) != numberOfReplicas {
+            t.Fatalf("key %v is on %v vertices of %v nodes", k, len(have), len(nodes))
+        }
+    }
+}
+
+func TestTokensBalanceKeys(t *testing.T) {
+    var g KVGraph
+    g.SetByRing(Ring{1, ringOf("", "", "", "")})
+    const keys = 20000
+    for addr, n := range ownership(&g, keys) {
+        // each of the four should own about a quarter
+        if n < keys / 6 || n > keys / 3 {
+            t.Errorf("%v owns %v of %v keys", addr, n, keys)
+        }
+    }
+}
+
+func TestWeightedTokens(t *testing.T) {
+    var g KVGraph
+    g.SetByRing(Ring{1, ringOf("2", "", "", "bogus")})
+    owned := ownership(&g, 20000)
+    if owned["host0"] < owned["host1"] * 3 / 2 || owned["host0"] < owned["host3"] * 3 / 2 {
+        t.Error("a member with weight 2 does not own more keys:", owned)
+    }
+}
+
+func TestJoinTakesKeysFromEveryNode(t *testing.T) {
+    var before, after KVGraph
+    members := ringOf("", "", "", "", "")
+    before.SetByRing(Ring{1, members[:4]})
+    after.SetByRing(Ring{2, members})
+
+    r := rand.New(rand.NewSource(1))
+    givers := make(map[string]int)
+    for i := 0; i < 5000; i++ {
+        k := Key(r.Uint32())
+        if after.FindVerticies(k)[0].Addr == "host4" {
+            givers[before.FindVerticies(k)[0].Addr]++
+        }
+    }
+    if len(givers) != 4 {
+        t.Error("the new node only took keys from", givers)
+    }
+}
+
+// A dropped member is put back with its rack and tokens, so every key gets
+// the replicas it had while the member was in the ring
+func TestDroppedMemberRingMatchesTheOldRing(t *testing.T) {
+    members := ringOf("", "", "", "", "2")
+    for i, rack := range []string{"a", "a", "b", "b", "a"} {
+        members[i].Rack = rack
+    }
+    var g KVGraph
+    g.SetByRing(Ring{1, members})
+    old := g.NodeIndex
+    g.SetByRing(Ring{2, members[:4]})
+    rebuilt := g.ringWith([]membertable.ID{members[4].ID})
+
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        k := Key(r.Uint32())
+        want, got := verticiesHave(k, old), verticiesHave(k, rebuilt)
+        for j := range want {
+            if j >= len(got) || got[j].Addr != want[j].Addr {
+                t.Fatalf("key %v has replicas %v, had %v", k, addrs(got), addrs(want))
+            }
+        }
+    }
+}
+
+func addrs(verts []*Vertex) []string {
+    var list []string
+    for _, v := range verts {
+        list = append(list, v.Addr)
+    }
+    return list
+}
+
+// Connects to KVNodes in this process over pipes. Addresses in down refuse
+// connections, and ones in hung take calls but never answer.
+type pipeConnector struct {
+    servers map[string]*rpc.Server
+    down map[string]bool
+    hung map[string]bool
+    mutex sync.Mutex
+}
+
+func (p *pipeConnector) Connect(addr string) (*rpc.Client, error) {
+    p.mutex.Lock()
+    server, ok := p.servers[addr]
+    down, hung := p.down[addr], p.hung[addr]
+    p.mutex.Unlock()
+    if !ok || down {
+        return nil, errors.New("connection refused")
+    }
+    client, conn := net.Pipe()
+    if hung {
+        go io.Copy(ioutil.Discard, conn)
+    } else {
+        go server.ServeConn(conn)
+    }
+    return rpc.NewClient(client), nil
+}
+
+func (p *pipeConnector) Release(addr string, client *rpc.Client, err error) {
+    client.Close()
+}
+
+func (p *pipeConnector) setDown(addr string, down bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.down[addr] = down
+}
+
+func (p *pipeConnector) setHung(addr string, hung bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.hung[addr] = hung
+}
+
+// A graph over n nodes named host0 to host(n-1)
+func newPipeGraph(n int) (*KVGraph, map[string]*KVNode, *pipeConnector) {
+    weights := make([]string, n)
+    connector := &pipeConnector{servers: make(map[string]*rpc.Server), down: make(map[string]bool), hung: make(map[string]bool)}
+    nodes := make(map[string]*KVNode)
+    for i := range weights {
+        addr := "host" + strconv.Itoa(i)
+        node := NewNode(0)
+        node.Name = addr
+        server := rpc.NewServer()
+        server.Register(node)
+        connector.servers[addr] = server
+        nodes[addr] = node
+    }
+    g := &KVGraph{Connector: connector}
+    g.SetByRing(Ring{1, ringOf(weights...)})
+    return g, nodes, connector
+}
+
+func TestLookupReturnsSiblings(t *testing.T) {
+    g, _, connector := newPipeGraph(4)
+    k := Key(7)
+    if err := g.Insert(KeyValue{Key: k, Value: "x"}, All); err != nil {
+        t.Fatal(err)
+    }
+
+    // With the usual coordinator down, another replica versions the next
+    // blind write, which is concurrent with the first
+    first := g.FindVerticies(k)[0].Addr
+    connector.setDown(first, true)
+    if err := g.Insert(KeyValue{Key: k, Value: "y"}, Quorum); err != nil {
+        t.Fatal(err)
+    }
+    connector.setDown(first, false)
+
+    siblings, err := g.Lookup(k, All)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(siblings) != 2 {
+        t.Fatal("lookup returned", siblings)
+    }
+
+    // The client resolves them by writing back with their context
+    if err = g.Insert(KeyValue{Key: k, Version: siblings.Context(), Value: "xy"}, All); err != nil {
+        t.Fatal(err)
+    }
+    siblings, err = g.Lookup(k, One)
+    if err != nil || len(siblings) != 1 || siblings[0].Value != "xy" {
+        t.Error("after resolving, lookup returned", siblings, err)
+    }
+}
+
+func TestUpdateRequiresExistingKey(t *testing.T) {
+    g, nodes, _ := newPipeGraph(4)
+    k := Key(7)
+    if err := g.Update(KeyValue{Key: k, Value: "x"}, One); err != ErrNoKey {
+        t.Fatal("update of a missing key gave", err)
+    }
+    for addr, node := range nodes {
+        if len(node.Siblings(k)) != 0 {
+            t.Fatal("update created the key on", addr)
+        }
+    }
+
+    // A replica that missed the insert does not stop the update
+    g.Insert(KeyValue{Key: k, Value: "x"}, All)
+    siblings, _ := g.Lookup(k, All)
+    nodes[g.FindVerticies(k)[0].Addr].Forget(k)
+    if err := g.Update(KeyValue{Key: k, Version: siblings.Context(), Value: "y"}, All); err != nil {
+        t.Fatal(err)
+    }
+    siblings, err := g.Lookup(k, All)
+    if err != nil || len(siblings) != 1 || siblings[0].Value != "y" {
+        t.Error("after update, lookup returned", siblings, err)
+    }
+
+    // and a deleted key can't be updated either
+    g.Delete(k, All)
+    if err := g.Update(KeyValue{Key: k, Value: "z"}, Quorum); err != ErrNoKey {
+        t.Error("update of a deleted key gave", err)
+    }
+}
+
+func TestWritesNeedTheirLevel(t *testing.T) {
+    g, _, connector := newPipeGraph(4)
+    k := Key(7)
+    g.Insert(KeyValue{Key: k, Value: "x"}, All)
+    verts := g.FindVerticies(k)
+    connector.setDown(verts[0].Addr, true)
+    connector.setDown(verts[1].Addr, true)
+
+    ops := map[string]func(c ConstLvl) error{
+        "insert": func(c ConstLvl) error { return g.Insert(KeyValue{Key: k, Value: "y"}, c) },
+        "update": func(c ConstLvl) error { return g.Update(KeyValue{Key: k, Value: "y"}, c) },
+        "delete": func(c ConstLvl) error { return g.Delete(k, c) },
+        "lookup": func(c ConstLvl) error { _, err := g.Lookup(k, c); return err },
+    }
+    for name, op := range ops {
+        if err := op(Quorum); err != ErrConstNotMet {
+            t.Error(name, "at quorum with one replica up gave", err)
+        }
+        if err := op(One); err != nil {
+            t.Error(name, "at one with one replica up gave", err)
+        }
+    }
+}
+
+func TestDeletedKeysStayDeleted(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    k := Key(7)
+    if err := g.Insert(KeyValue{Key: k, Value: "x"}, All); err != nil {
+        t.Fatal(err)
+    }
+    var old Siblings
+    stale := nodes[g.FindVerticies(k)[2].Addr]
+    stale.Lookup(&k, &old)
+
+    // One replica misses the delete
+    connector.setDown(stale.Name, true)
+    if err := g.Delete(k, Quorum); err != nil {
+        t.Fatal(err)
+    }
+    connector.setDown(stale.Name, false)
+
+    // The stale replica repairing its old value loses to the tombstone
+    g.replicate(old[0])
+    siblings, err := g.Lookup(k, All)
+    if err != nil || len(siblings.Live()) != 0 {
+        t.Fatal("deleted key came back as", siblings, err)
+    }
+
+    // and the lookup repaired the stale replica
+    var repaired Siblings
+    for i := 0; i < 100; i++ {
+        stale.Lookup(&k, &repaired)
+        if len(repaired) == 1 && repaired[0].Deleted {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Error("stale replica still has", repaired)
+}
+
+func TestTombstonesAreCollected(t *testing.T) {
+    node := NewNode(0)
+    node.TombstoneGrace = 1
+    k := Key(3)
+    var stored KeyValue
+    node.Put(&KeyValue{Key: k, Value: "x"}, &stored)
+    node.Delete(&KeyValue{Key: k}, &stored)
+    if !stored.Deleted || stored.Version.Compare(VersionVector{"": 1}) != After {
+        t.Fatal("delete stored", stored)
+    }
+
+    time.Sleep(time.Millisecond)
+    if n := node.CollectTombstones(); n != 1 {
+        t.Error("collected", n, "tombstones")
+    }
+    if len(node.Siblings(k)) != 0 {
+        t.Error("key still there after its tombstone was collected")
+    }
+}
+
+func TestHungCoordinatorDoesNotStallWrites(t *testing.T) {
+    g, _, connector := newPipeGraph(4)
+    g.Timeout = 300 * time.Millisecond
+    k := Key(7)
+    verts := g.FindVerticies(k)
+
+    // The first replica tried hangs, so the next one coordinates
+    connector.setHung(verts[0].Addr, true)
+    start := time.Now()
+    if err := g.Insert(KeyValue{Key: k, Value: "x"}, One); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed >= g.Timeout {
+        t.Error("write took", elapsed)
+    }
+
+    // With every replica hung, finding a coordinator still takes one timeout
+    for _, v := range verts {
+        connector.setHung(v.Addr, true)
+    }
+    start = time.Now()
+    if err := g.Insert(KeyValue{Key: k, Value: "y"}, One); err == nil {
+        t.Fatal("write to hung replicas worked")
+    }
+    if elapsed := time.Since(start); elapsed > g.Timeout + 100 * time.Millisecond {
+        t.Error("failed write took", elapsed)
+    }
+}
+
+func TestHungReplicaDoesNotStallRequests(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    g.Timeout = 200 * time.Millisecond
+    k := Key(7)
+    verts := g.FindVerticies(k)
+    last := verts[2].Addr
+    connector.setHung(last, true)
+
+    // The other two replicas are a quorum, so neither waits for the hung one
+    start := time.Now()
+    if err := g.Insert(KeyValue{Key: k, Value: "x"}, Quorum); err != nil {
+        t.Fatal(err)
+    }
+    if siblings, err := g.Lookup(k, Quorum); err != nil || len(siblings) != 1 {
+        t.Fatal("lookup returned", siblings, err)
+    }
+    if elapsed := time.Since(start); elapsed >= g.Timeout {
+        t.Error("requests took", elapsed)
+    }
+
+    // but one that needs it gives up at the deadline
+    start = time.Now()
+    if _, err := g.Lookup(k, All); err != ErrConstNotMet {
+        t.Error("lookup at all gave", err)
+    }
+    if elapsed := time.Since(start); elapsed > 2 * g.Timeout {
+        t.Error("lookup at all took", elapsed)
+    }
+
+    // Once it answers again, a lookup that already returned still repairs it
+    connector.setHung(last, false)
+    if _, err := g.Lookup(k, One); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 100 && len(nodes[last].Siblings(k)) == 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(nodes[last].Siblings(k)) != 1 {
+        t.Error("hung replica was not repaired")
+    }
+}
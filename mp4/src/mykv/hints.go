@@ -0,0 +1,128 @@
+package mykv
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// How many hints a node holds at most; past that the oldest are dropped
+const DefaultMaxHints = 10000
+
+// How long a hint is held. Shorter than the tombstone grace, so a hint can't
+// outlive the tombstone of a later delete and bring the key back.
+const DefaultHintMaxAge = DefaultTombstoneGrace / 2
+
+// How often held hints are retried, for replicas that come back without
+// the membership noticing they were gone
+const HintInterval = 10 * time.Second
+
+// A write a replica missed, held until it can be handed over
+type Hint struct {
+    // the replica the write was meant for
+    Addr string
+    KeyValue KeyValue
+    // when the hint was taken, by the holder's clock
+    At Timestamp
+}
+
+// Hints held for replicas that could not be reached. They are only kept in
+// memory; anything lost is left to repair.
+type Hints struct {
+    MaxHints int
+    MaxAge Timestamp
+
+    hints map[string][]Hint
+    count int
+    mutex sync.Mutex
+}
+
+func NewHints() *Hints {
+    return &Hints{MaxHints: DefaultMaxHints, MaxAge: DefaultHintMaxAge, hints: make(map[string][]Hint)}
+}
+
+// Hold a hint, dropping the oldest one held if there are too many
+func (h *Hints) Add(hint Hint) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    if hint.At == 0 {
+        hint.At = StampNow()
+    }
+    h.hints[hint.Addr] = append(h.hints[hint.Addr], hint)
+    h.count++
+    for h.count > h.MaxHints {
+        h.dropOldest()
+    }
+}
+
+// Each address's hints are in the order they were taken
+func (h *Hints) dropOldest() {
+    oldest := ""
+    for addr, hints := range h.hints {
+        if oldest == "" || hints[0].At < h.hints[oldest][0].At {
+            oldest = addr
+        }
+    }
+    log.Println("too many hints; dropping one for", oldest)
+    h.remove(oldest, 1)
+}
+
+func (h *Hints) remove(addr string, n int) {
+    h.hints[addr] = h.hints[addr][n:]
+    h.count -= n
+    if len(h.hints[addr]) == 0 {
+        delete(h.hints, addr)
+    }
+}
+
+// Drop hints older than MaxAge. Returns how many were dropped.
+func (h *Hints) Expire() int {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    return h.expire()
+}
+
+func (h *Hints) expire() int {
+    cutoff := StampNow() - h.MaxAge
+    dropped := 0
+    for addr, hints := range h.hints {
+        n := 0
+        for n < len(hints) && hints[n].At < cutoff {
+            n++
+        }
+        if n > 0 {
+            h.remove(addr, n)
+            dropped += n
+        }
+    }
+    return dropped
+}
+
+// Remove and return the hints held for addr that haven't expired
+func (h *Hints) Take(addr string) []Hint {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.expire()
+    hints := h.hints[addr]
+    if len(hints) > 0 {
+        h.remove(addr, len(hints))
+    }
+    return hints
+}
+
+// The addresses hints are held for
+func (h *Hints) Addrs() []string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    addrs := make([]string, 0, len(h.hints))
+    for addr := range h.hints {
+        addrs = append(addrs, addr)
+    }
+    return addrs
+}
+
+func (h *Hints) Len() int {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    return h.count
+}
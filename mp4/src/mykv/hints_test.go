@@ -0,0 +1,94 @@
+package mykv
+
+import (
+    "testing"
+    "time"
+
+    "membertable"
+)
+
+func TestHintsAreBounded(t *testing.T) {
+    h := NewHints()
+    h.MaxHints = 3
+    for i := 0; i < 5; i++ {
+        h.Add(Hint{Addr: "a", KeyValue: KeyValue{Key: Key(i)}, At: Timestamp(i + 1)})
+    }
+    h.Add(Hint{Addr: "b", KeyValue: KeyValue{Key: 9}, At: 10})
+    if h.Len() != 3 {
+        t.Fatal("holding", h.Len(), "hints")
+    }
+    // ancient hints are past MaxAge, so check what is left without Take
+    if hints := h.hints["a"]; len(hints) != 2 || hints[0].KeyValue.Key != 3 {
+        t.Error("kept", hints)
+    }
+}
+
+func TestHintsExpire(t *testing.T) {
+    h := NewHints()
+    h.MaxAge = Timestamp(time.Minute)
+    h.Add(Hint{Addr: "a", KeyValue: KeyValue{Key: 1}, At: StampNow() - Timestamp(2 * time.Minute)})
+    h.Add(Hint{Addr: "a", KeyValue: KeyValue{Key: 2}})
+    hints := h.Take("a")
+    if len(hints) != 1 || hints[0].KeyValue.Key != 2 {
+        t.Error("took", hints)
+    }
+    if h.Len() != 0 || len(h.Addrs()) != 0 {
+        t.Error("still holding", h.Len(), "hints for", h.Addrs())
+    }
+}
+
+func TestHintsReplayWhenReplicaReturns(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    k := Key(7)
+    verts := g.FindVerticies(k)
+    // This graph is the node that is not a replica of k
+    me := g.hintHolders(k)[0].Addr
+    g.SetLocalNode(me, nodes[me])
+
+    down := verts[1].Addr
+    connector.setDown(down, true)
+    if err := g.Insert(KeyValue{Key: k, Value: "x"}, Quorum); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 100 && nodes[me].Hints.Len() == 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if nodes[me].Hints.Len() != 1 {
+        t.Fatal("holding", nodes[me].Hints.Len(), "hints")
+    }
+
+    // Still down: the hint is kept for later
+    g.ReplayHints([]membertable.ID{{Address: down}})
+    if nodes[me].Hints.Len() != 1 {
+        t.Fatal("lost the hint replaying to a down replica")
+    }
+
+    connector.setDown(down, false)
+    g.ReplayHints([]membertable.ID{{Address: down}})
+    if siblings := nodes[down].Siblings(k); len(siblings) != 1 || siblings[0].Value != "x" {
+        t.Error("returning replica has", siblings)
+    }
+    if nodes[me].Hints.Len() != 0 {
+        t.Error("still holding", nodes[me].Hints.Len(), "hints")
+    }
+}
+
+func TestHintsGoToTheNextNode(t *testing.T) {
+    g, nodes, connector := newPipeGraph(4)
+    k := Key(7)
+    down := g.FindVerticies(k)[0].Addr
+    connector.setDown(down, true)
+    if err := g.Delete(k, Quorum); err != nil {
+        t.Fatal(err)
+    }
+
+    // With no node of its own, the graph hands the hint past the replicas
+    holder := nodes[g.hintHolders(k)[0].Addr]
+    for i := 0; i < 100 && holder.Hints.Len() == 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    hints := holder.Hints.Take(down)
+    if len(hints) != 1 || !hints[0].KeyValue.Deleted {
+        t.Error("next node holds", hints)
+    }
+}
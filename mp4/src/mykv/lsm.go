@@ -0,0 +1,472 @@
+package mykv
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// How many keys the memtable holds before it is flushed to a table
+var MemtableKeys = 4096
+
+// How many tables can pile up before they are compacted into one
+var CompactAt = 4
+
+const manifestName = "MANIFEST"
+
+// A store for more keys than fit in memory. Writes go to a log and a
+// memtable; full memtables are written out as sorted tables, and tables are
+// merged in the background so lookups never have to look at many.
+//
+// The manifest lists the live tables, newest first; anything else in the
+// directory is left over from a crash and is removed when the store opens.
+type LSMStore struct {
+    Dir string
+    Sync SyncPolicy
+
+    memtable map[Key]walRecord
+    wal walFile
+    // newest first, so the first table with a key has its latest record
+    tables []*sstable
+    nextTable int
+    dirty bool
+    compacting bool
+    compactions chan bool
+    closed bool
+    // set if a failed write could not be cut off the log
+    damaged bool
+    mutex sync.Mutex
+}
+
+// Something a store can walk in key order
+type OrderedStore interface {
+    Store
+    // Call fn with every key from start on, in order, until it returns false
+    Scan(start Key, fn func(k Key, siblings Siblings) bool) error
+}
+
+func OpenLSMStore(dir string, sync SyncPolicy) (*LSMStore, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    s := &LSMStore{Dir: dir, Sync: sync, memtable: make(map[Key]walRecord), compactions: make(chan bool, 1)}
+    if err := s.loadManifest(); err != nil {
+        return nil, err
+    }
+    wal, _, err := replayLog(filepath.Join(dir, walName), func(record walRecord) {
+        s.memtable[record.Key] = record
+    })
+    if err != nil {
+        return nil, err
+    }
+    s.wal = wal
+    go s.compactProcess()
+    if sync == SyncBatch {
+        go s.syncProcess()
+    }
+    return s, nil
+}
+
+func (s *LSMStore) loadManifest() error {
+    data, err := ioutil.ReadFile(filepath.Join(s.Dir, manifestName))
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    live := make(map[string]bool)
+    for _, name := range strings.Fields(string(data)) {
+        table, err := openSSTable(filepath.Join(s.Dir, name))
+        if err != nil {
+            return err
+        }
+        s.tables = append(s.tables, table)
+        live[name] = true
+    }
+
+    // Tables a crash left out of the manifest, and leftover temporary files
+    files, err := ioutil.ReadDir(s.Dir)
+    if err != nil {
+        return err
+    }
+    for _, file := range files {
+        var n int
+        if _, err := fmt.Sscanf(file.Name(), "%d.sst", &n); err == nil && n >= s.nextTable {
+            s.nextTable = n + 1
+        }
+        if (strings.HasSuffix(file.Name(), ".sst") || strings.HasSuffix(file.Name(), ".tmp")) && !live[file.Name()] {
+            os.Remove(filepath.Join(s.Dir, file.Name()))
+        }
+    }
+    return nil
+}
+
+// Replace the manifest with the current tables
+func (s *LSMStore) writeManifest() error {
+    var names []string
+    for _, table := range s.tables {
+        names = append(names, filepath.Base(table.filename))
+    }
+    name := filepath.Join(s.Dir, manifestName)
+    tmpName := name + ".tmp"
+    f, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+    if _, err = f.WriteString(strings.Join(names, "\n") + "\n"); err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        return err
+    }
+    if err = os.Rename(tmpName, name); err != nil {
+        return err
+    }
+    if dir, err := os.Open(s.Dir); err == nil {
+        dir.Sync()
+        dir.Close()
+    }
+    return nil
+}
+
+func (s *LSMStore) newTableName() string {
+    name := filepath.Join(s.Dir, fmt.Sprintf("%08d.sst", s.nextTable))
+    s.nextTable++
+    return name
+}
+
+// The latest record for k, from the memtable or the newest table with it
+func (s *LSMStore) lookup(k Key) (walRecord, bool) {
+    if record, ok := s.memtable[k]; ok {
+        return record, true
+    }
+    for _, table := range s.tables {
+        record, ok, err := table.get(k)
+        if err != nil {
+            log.Println("could not read", table.filename, ":", err)
+            continue
+        }
+        if ok {
+            return record, true
+        }
+    }
+    return walRecord{}, false
+}
+
+func (s *LSMStore) Get(k Key) Siblings {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    record, ok := s.lookup(k)
+    if !ok || record.Removed {
+        return nil
+    }
+    return record.siblings()
+}
+
+func (s *LSMStore) write(record walRecord) error {
+    if s.closed {
+        return ErrStoreClosed
+    }
+    if s.damaged {
+        return ErrLogDamaged
+    }
+    if err := appendRecord(s.wal, record); err != nil {
+        s.damaged = err == ErrLogDamaged
+        return err
+    }
+    s.dirty = true
+    if s.Sync == SyncAlways {
+        if err := s.wal.Sync(); err != nil {
+            return err
+        }
+        s.dirty = false
+    }
+    s.memtable[record.Key] = record
+    if len(s.memtable) >= MemtableKeys {
+        if err := s.flush(); err != nil {
+            log.Println("could not flush the memtable:", err)
+        }
+    }
+    return nil
+}
+
+func (s *LSMStore) Put(k Key, siblings Siblings) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.write(newRecord(k, siblings))
+}
+
+// Removing writes a marker that hides the key in older tables until a
+// compaction of every table drops both
+func (s *LSMStore) Remove(k Key) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.write(walRecord{Key: k, Removed: true})
+}
+
+func sortedRecords(memtable map[Key]walRecord) []walRecord {
+    records := make([]walRecord, 0, len(memtable))
+    for _, record := range memtable {
+        records = append(records, record)
+    }
+    sort.Slice(records, func(i, j int) bool {
+        return records[i].Key < records[j].Key
+    })
+    return records
+}
+
+// Write the memtable out as the newest table and start a new log
+func (s *LSMStore) flush() error {
+    if len(s.memtable) == 0 {
+        return nil
+    }
+    name := s.newTableName()
+    if err := writeSSTable(name, sortedRecords(s.memtable)); err != nil {
+        return err
+    }
+    table, err := openSSTable(name)
+    if err != nil {
+        return err
+    }
+    s.tables = append([]*sstable{table}, s.tables...)
+    if err = s.writeManifest(); err != nil {
+        return err
+    }
+
+    // The table has everything in the log now
+    if err = s.wal.Truncate(0); err == nil {
+        _, err = s.wal.Seek(0, 0)
+    }
+    if err != nil {
+        return err
+    }
+    s.memtable = make(map[Key]walRecord)
+    s.dirty = false
+    s.damaged = false
+
+    if len(s.tables) >= CompactAt && !s.compacting {
+        select {
+        case s.compactions <- true:
+        default:
+        }
+    }
+    return nil
+}
+
+func (s *LSMStore) compactProcess() {
+    for _ = range s.compactions {
+        if err := s.Compact(); err != nil {
+            log.Println("compaction failed:", err)
+        }
+    }
+}
+
+// Merge every table into one. Writes carry on while the new table is built;
+// tables flushed in the meantime stay in front of it.
+func (s *LSMStore) Compact() error {
+    s.mutex.Lock()
+    if s.compacting || s.closed || len(s.tables) < 2 {
+        s.mutex.Unlock()
+        return nil
+    }
+    s.compacting = true
+    inputs := s.acquire()
+    name := s.newTableName()
+    s.mutex.Unlock()
+
+    // Every table is merged, so nothing older can be hiding behind a removed
+    // key and it can be dropped
+    var records []walRecord
+    err := mergeTables(inputs, 0, func(record walRecord) bool {
+        if !record.Removed {
+            records = append(records, record)
+        }
+        return true
+    })
+    if err == nil {
+        err = writeSSTable(name, records)
+    }
+    var table *sstable
+    if err == nil {
+        table, err = openSSTable(name)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.compacting = false
+    for _, old := range inputs {
+        old.refs--
+    }
+    if err != nil {
+        return err
+    }
+    if s.closed {
+        table.close()
+        return ErrStoreClosed
+    }
+    // The inputs are the oldest tables
+    s.tables = append(s.tables[:len(s.tables) - len(inputs)], table)
+    if err = s.writeManifest(); err != nil {
+        return err
+    }
+    for _, old := range inputs {
+        old.obsolete = true
+        old.release()
+    }
+    return nil
+}
+
+// Hold on to the current tables so a compaction does not delete them while
+// they are read without the lock
+func (s *LSMStore) acquire() []*sstable {
+    tables := append([]*sstable(nil), s.tables...)
+    for _, table := range tables {
+        table.refs++
+    }
+    return tables
+}
+
+func (s *LSMStore) releaseAll(tables []*sstable) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    for _, table := range tables {
+        table.refs--
+        table.release()
+    }
+}
+
+// Call fn with the latest record of every key in the tables (newest first)
+// from start on, in key order
+func mergeTables(tables []*sstable, start Key, fn func(walRecord) bool) error {
+    iterators := make([]*tableIterator, len(tables))
+    for i, table := range tables {
+        iterators[i] = table.iterator(start)
+    }
+    for {
+        // The smallest key any table is at; the newest table with it wins
+        newest := -1
+        for i, it := range iterators {
+            if it.err != nil {
+                return it.err
+            }
+            if it.valid() && (newest < 0 || it.record().Key < iterators[newest].record().Key) {
+                newest = i
+            }
+        }
+        if newest < 0 {
+            return nil
+        }
+        record := iterators[newest].record()
+        for _, it := range iterators {
+            if it.valid() && it.record().Key == record.Key {
+                it.next()
+            }
+        }
+        if !fn(record) {
+            return nil
+        }
+    }
+}
+
+// Walk the keys from start on in order. The memtable and the tables are read
+// as they were when the scan started.
+func (s *LSMStore) Scan(start Key, fn func(k Key, siblings Siblings) bool) error {
+    s.mutex.Lock()
+    var memtable []walRecord
+    for _, record := range sortedRecords(s.memtable) {
+        if record.Key >= start {
+            memtable = append(memtable, record)
+        }
+    }
+    tables := s.acquire()
+    s.mutex.Unlock()
+    defer s.releaseAll(tables)
+
+    // The memtable is newer than any table
+    stopped := false
+    visit := func(record walRecord) bool {
+        if record.Removed {
+            return true
+        }
+        stopped = !fn(record.Key, record.siblings())
+        return !stopped
+    }
+    err := mergeTables(tables, start, func(record walRecord) bool {
+        for len(memtable) > 0 && memtable[0].Key <= record.Key {
+            if memtable[0].Key == record.Key {
+                record = memtable[0]
+                memtable = memtable[1:]
+                break
+            }
+            if !visit(memtable[0]) {
+                return false
+            }
+            memtable = memtable[1:]
+        }
+        return visit(record)
+    })
+    for err == nil && !stopped && len(memtable) > 0 {
+        visit(memtable[0])
+        memtable = memtable[1:]
+    }
+    return err
+}
+
+func (s *LSMStore) Keys() []Key {
+    var keys []Key
+    if err := s.Scan(0, func(k Key, siblings Siblings) bool {
+        keys = append(keys, k)
+        return true
+    }); err != nil {
+        log.Println("could not list keys:", err)
+    }
+    return keys
+}
+
+// Counts every key, so it reads every table
+func (s *LSMStore) Len() int {
+    return len(s.Keys())
+}
+
+// Flush the memtable, so opening the store again does not have to replay
+// the log, and close every file
+func (s *LSMStore) Close() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.closed {
+        return nil
+    }
+    err := s.flush()
+    s.closed = true
+    close(s.compactions)
+    for _, table := range s.tables {
+        table.close()
+    }
+    if closeErr := s.wal.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+func (s *LSMStore) syncProcess() {
+    for {
+        time.Sleep(SyncInterval)
+        s.mutex.Lock()
+        if s.closed {
+            s.mutex.Unlock()
+            return
+        }
+        if s.dirty {
+            if err := s.wal.Sync(); err != nil {
+                log.Println("could not sync the write-ahead log:", err)
+            }
+            s.dirty = false
+        }
+        s.mutex.Unlock()
+    }
+}
@@ -0,0 +1,227 @@
+package mykv
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func tempLSMStore(t *testing.T) (*LSMStore, string) {
+    dir, err := ioutil.TempDir("", "lsmstore")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := OpenLSMStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return s, dir
+}
+
+// Flush every few keys so tests see tables without writing thousands
+func smallTables(memtableKeys, compactAt int) func() {
+    oldKeys, oldCompact := MemtableKeys, CompactAt
+    MemtableKeys, CompactAt = memtableKeys, compactAt
+    return func() {
+        MemtableKeys, CompactAt = oldKeys, oldCompact
+    }
+}
+
+func tables(dir string) []string {
+    names, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+    return names
+}
+
+func TestSSTableLookups(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "sstable")
+    defer os.RemoveAll(dir)
+    var records []walRecord
+    for k := Key(0); k < 2000; k += 2 {
+        records = append(records, newRecord(k, value(fmt.Sprint(k))))
+    }
+    name := filepath.Join(dir, "test.sst")
+    if err := writeSSTable(name, records); err != nil {
+        t.Fatal(err)
+    }
+    table, err := openSSTable(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer table.close()
+    if len(table.index) < 2 {
+        t.Error("expected several blocks, got", len(table.index))
+    }
+
+    for k := Key(0); k < 2000; k++ {
+        record, ok, err := table.get(k)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if ok != (k % 2 == 0) || ok && record.Siblings[0].Value != fmt.Sprint(k) {
+            t.Fatal("lookup of", k, "gave", ok, record)
+        }
+    }
+
+    // Most keys that aren't there never get past the bloom filter
+    passed := 0
+    for k := Key(1); k < 2000; k += 2 {
+        if bloomHas(table.bloom, k) {
+            passed++
+        }
+    }
+    if passed > 50 {
+        t.Error(passed, "of 1000 missing keys passed the bloom filter")
+    }
+}
+
+func TestLSMStoreFlushesAndReopens(t *testing.T) {
+    defer smallTables(10, 100)()
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    for k := Key(0); k < 35; k++ {
+        s.Put(k, value(fmt.Sprint(k)))
+    }
+    s.Remove(3)
+    s.Put(4, value("four"))
+    if len(tables(dir)) != 3 {
+        t.Error("expected 3 tables, got", tables(dir))
+    }
+
+    // Reopen without closing, so the last keys come from the log
+    s, err := OpenLSMStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    if s.Get(3) != nil || s.Get(4)[0].Value != "four" || s.Get(34)[0].Value != "34" {
+        t.Error("recovered", s.Get(3), s.Get(4), s.Get(34))
+    }
+    if s.Len() != 34 {
+        t.Error("expected 34 keys, got", s.Len())
+    }
+}
+
+func TestLSMStoreCompacts(t *testing.T) {
+    defer smallTables(10, 3)()
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    for round := 0; round < 3; round++ {
+        for k := Key(0); k < 10; k++ {
+            s.Put(k, value(fmt.Sprint(k, round)))
+        }
+    }
+    s.Remove(5)
+    s.Close()
+
+    s, err := OpenLSMStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    // The close flushed a fourth table; merging everything drops key 5
+    // entirely and keeps the newest of the rest
+    if err = s.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    if len(tables(dir)) != 1 {
+        t.Fatal("expected 1 table, got", tables(dir))
+    }
+    if s.tables[0].keys != 9 || s.Get(5) != nil || s.Get(9)[0].Value != "9 2" {
+        t.Error("compacted to", s.tables[0].keys, "keys", s.Get(5), s.Get(9))
+    }
+}
+
+func TestLSMStoreCompactsInBackground(t *testing.T) {
+    defer smallTables(5, 3)()
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    defer s.Close()
+    for k := Key(0); k < 15; k++ {
+        s.Put(k, value(fmt.Sprint(k)))
+    }
+    for i := 0; i < 100 && len(tables(dir)) != 1; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(tables(dir)) != 1 || s.Len() != 15 {
+        t.Error("after compacting:", tables(dir), s.Len(), "keys")
+    }
+}
+
+func TestLSMStoreScansInOrder(t *testing.T) {
+    defer smallTables(8, 100)()
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    defer s.Close()
+    // Spread keys and overwrites over tables and the memtable
+    for i := 0; i < 30; i++ {
+        k := Key(i * 7 % 30)
+        s.Put(k, value(fmt.Sprint(i)))
+    }
+    s.Put(12, value("latest"))
+    s.Remove(13)
+
+    var keys []Key
+    err := s.Scan(10, func(k Key, siblings Siblings) bool {
+        if k == 12 && siblings[0].Value != "latest" {
+            t.Error("scan gave an old value for 12:", siblings)
+        }
+        keys = append(keys, k)
+        return len(keys) < 5
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []Key{10, 11, 12, 14, 15}
+    if fmt.Sprint(keys) != fmt.Sprint(expected) {
+        t.Error("scanned", keys, "expected", expected)
+    }
+}
+
+func TestNodeScansAnyStore(t *testing.T) {
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    for _, node := range []*KVNode{NewNode(0), NewNodeWithStore(0, s)} {
+        for _, k := range []Key{9, 3, 6, 1} {
+            var reply KeyValue
+            node.Put(&KeyValue{Key: k, Value: "v"}, &reply)
+        }
+        var keys []Key
+        node.Scan(2, func(k Key, siblings Siblings) bool {
+            keys = append(keys, k)
+            return true
+        })
+        if fmt.Sprint(keys) != "[3 6 9]" {
+            t.Errorf("%T scanned %v", node.Store, keys)
+        }
+        node.Store.Close()
+    }
+}
+
+func TestLSMStoreCutsOffFailedWrite(t *testing.T) {
+    s, dir := tempLSMStore(t)
+    defer os.RemoveAll(dir)
+    wal := &failingLog{File: s.wal.(*os.File)}
+    s.wal = wal
+    s.Put(1, value("one"))
+    wal.fail = true
+    if err := s.Put(2, value("two")); err == nil {
+        t.Fatal("failed write returned no error")
+    }
+    wal.fail = false
+    if err := s.Put(3, value("three")); err != nil {
+        t.Fatal(err)
+    }
+
+    // Reopen without closing, so the log is replayed
+    recovered, err := OpenLSMStore(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer recovered.Close()
+    if recovered.Get(2) != nil || recovered.Get(3) == nil || len(recovered.Keys()) != 2 {
+        t.Error("recovered", recovered.Keys())
+    }
+}
@@ -0,0 +1,98 @@
+package mykv
+
+import (
+    "encoding/binary"
+    "hash/fnv"
+    "sort"
+)
+
+// Depth of a merkle tree. The leaves split the hashed key space into
+// 2^merkleDepth equal ranges.
+const merkleDepth = 12
+
+const merkleLeaves = 1 << merkleDepth
+
+// A hash tree over the keys two replicas share. Nodes are stored in heap
+// order: the root is 0 and the children of i are 2i+1 and 2i+2, so the
+// leaves are the last merkleLeaves nodes. A leaf is the XOR of the digests of
+// its keys, so keys can be added in any order; the tree is summed up once
+// every key is in.
+type merkleTree struct {
+    nodes []uint64
+    // the keys in each leaf, so the keys of a leaf that differs can be found
+    // without scanning the store
+    keys [][]Key
+}
+
+func newMerkleTree() *merkleTree {
+    return &merkleTree{nodes: make([]uint64, 2 * merkleLeaves - 1), keys: make([][]Key, merkleLeaves)}
+}
+
+// The leaf a key falls in
+func merkleLeaf(k Key) int {
+    return int(uint32(k.Hashed()) >> (32 - merkleDepth))
+}
+
+func leafNode(leaf int) int {
+    return merkleLeaves - 1 + leaf
+}
+
+func isLeafNode(n int) bool {
+    return n >= merkleLeaves - 1
+}
+
+// A digest of everything that makes one replica's copy of a key differ
+// from another's: each sibling's version, time and whether it is a
+// tombstone. Siblings are digested in a fixed order.
+func keyDigest(k Key, siblings Siblings) uint64 {
+    h := fnv.New64a()
+    binary.Write(h, binary.BigEndian, uint32(k))
+    digests := make([]uint64, 0, len(siblings))
+    for _, kv := range siblings {
+        sh := fnv.New64a()
+        nodes := make([]string, 0, len(kv.Version))
+        for node := range kv.Version {
+            nodes = append(nodes, node)
+        }
+        sort.Strings(nodes)
+        for _, node := range nodes {
+            sh.Write([]byte(node))
+            binary.Write(sh, binary.BigEndian, kv.Version[node])
+        }
+        binary.Write(sh, binary.BigEndian, int64(kv.Time))
+        binary.Write(sh, binary.BigEndian, kv.Deleted)
+        digests = append(digests, sh.Sum64())
+    }
+    sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+    binary.Write(h, binary.BigEndian, digests)
+    return h.Sum64()
+}
+
+func (t *merkleTree) add(k Key, siblings Siblings) {
+    leaf := merkleLeaf(k)
+    t.nodes[leafNode(leaf)] ^= keyDigest(k, siblings)
+    t.keys[leaf] = append(t.keys[leaf], k)
+}
+
+// Hash every inner node from its children, bottom up
+func (t *merkleTree) sum() {
+    var buf [16]byte
+    for n := merkleLeaves - 2; n >= 0; n-- {
+        binary.BigEndian.PutUint64(buf[:8], t.nodes[2 * n + 1])
+        binary.BigEndian.PutUint64(buf[8:], t.nodes[2 * n + 2])
+        h := fnv.New64a()
+        h.Write(buf[:])
+        t.nodes[n] = h.Sum64()
+    }
+}
+
+// The hashes of the given nodes
+func (t *merkleTree) get(nodes []int) []uint64 {
+    hashes := make([]uint64, len(nodes))
+    for i, n := range nodes {
+        if n >= 0 && n < len(t.nodes) {
+            hashes[i] = t.nodes[n]
+        }
+    }
+    return hashes
+}
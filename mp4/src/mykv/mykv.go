@@ -12,8 +12,14 @@ var (
     ErrNoKey = errors.New("no such key")
 )
 
+// How a KVGraph reaches other nodes. Clients may be shared between callers,
+// so every client from Connect is handed back with Release instead of being
+// closed.
 type RPCConnector interface {
     Connect(addr string) (*rpc.Client, error)
+    // err is what the last call made with the client returned, so a
+    // connector can drop clients whose connection broke
+    Release(addr string, client *rpc.Client, err error)
 }
 
 type Timestamp int64
@@ -33,8 +39,16 @@ func (k Key) Hashed() HashedKey {
 
 type KeyValue struct {
     Key Key
+    // the client's clock when it wrote; only used by LastWriteWins
     Time Timestamp
+    Version VersionVector
     Value interface{}
+    // a tombstone: the key was deleted at this version
+    Deleted bool
+
+    // when this replica learned of the tombstone, by its own clock; it is
+    // collected TombstoneGrace later. Unexported so it stays off the wire.
+    deletedAt Timestamp
 }
 
 func (kv KeyValue) HashedKey() HashedKey {
@@ -2,12 +2,34 @@ package mykv
 
 import (
     "log"
+    "sort"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
+// How long a tombstone is kept. A replica that misses a delete and stays
+// away longer than this can bring the key back, so it should be well past
+// the time repair takes to reach every replica.
+const DefaultTombstoneGrace = Timestamp(10 * time.Minute)
+
 type KVNode struct {
-    KeyValues map[Key]KeyValue
+    // every version of each key that no other version descends from
+    Store Store
+    // the name writes we coordinate are counted under in version vectors;
+    // our address, so it is unique in the cluster
+    Name string
+    Policy ConflictPolicy
+    // how long tombstones are kept; DefaultTombstoneGrace if zero
+    TombstoneGrace Timestamp
+    // writes held for replicas that were down
+    Hints *Hints
 
+    // bumped on every change to the store, so repair knows when its trees
+    // are out of date
+    changes int64
+    // writes since the node started, for Debug; a store's Len can be slow
+    writes int
     readIndex int
     writeIndex int
     recentReads [10]KeyValue
@@ -16,17 +38,58 @@ type KVNode struct {
     nodeMutex sync.Mutex
 }
 
+// A node that keeps its keys in memory
 func NewNode(hash HashedKey) *KVNode {
+    return NewNodeWithStore(hash, NewMemoryStore())
+}
+
+func NewNodeWithStore(hash HashedKey, store Store) *KVNode {
     return &KVNode{
-        KeyValues: make(map[Key]KeyValue),
+        Store: store,
+        Hints: NewHints(),
         maxHashedKey: hash,
     }
 }
 
 func (kv *KVNode) Debug() {
-    if len(kv.KeyValues) % 10000 == 0 {
-        log.Println(len(kv.KeyValues))
+    if kv.writes > 0 && kv.writes % 10000 == 0 {
+        log.Println(kv.writes, "writes")
+    }
+}
+
+// Every key the node has, tombstones included
+func (kv *KVNode) Keys() []Key {
+    return kv.Store.Keys()
+}
+
+// How many times the store has changed
+func (kv *KVNode) changeCount() int64 {
+    return atomic.LoadInt64(&kv.changes)
+}
+
+// The versions the node has of k
+func (kv *KVNode) Siblings(k Key) Siblings {
+    return kv.Store.Get(k)
+}
+
+// Call fn with every key from start on, in order, until it returns false.
+// Stores that keep keys sorted walk them directly; others are sorted first.
+func (kv *KVNode) Scan(start Key, fn func(k Key, siblings Siblings) bool) error {
+    if ordered, ok := kv.Store.(OrderedStore); ok {
+        return ordered.Scan(start, fn)
     }
+    keys := kv.Store.Keys()
+    sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+    for _, k := range keys {
+        if k < start {
+            continue
+        }
+        siblings := kv.Store.Get(k)
+        if len(siblings) > 0 && !fn(k, siblings) {
+            break
+        }
+    }
+    return nil
 }
 
 func (kv *KVNode) Show() {
@@ -46,84 +109,191 @@ func (kv *KVNode) Show() {
     }
 }
 
+// Remember a write for Show
+func (kv *KVNode) recordWrite(keyValue KeyValue) {
+    kv.writes++
+    kv.writeIndex -= 1
+    if kv.writeIndex < 0 {
+        kv.writeIndex = 9
+    }
+    kv.recentWrites[kv.writeIndex] = keyValue
+}
+
+// Store a version some other replica coordinated, as long as we don't
+// already have it or something newer
 func (kv *KVNode) Insert(args *KeyValue, reply *bool) error {
     kv.nodeMutex.Lock()
     defer kv.nodeMutex.Unlock()
     defer kv.Debug()
-    keyValue, ok := kv.KeyValues[args.Key]
-    if !ok {
-        kv.KeyValues[args.Key] = *args
-    } else if args.Time > keyValue.Time {
-        kv.KeyValues[args.Key] = *args
-    }
-    kv.writeIndex -= 1
-    if kv.writeIndex < 0 {
-        kv.writeIndex = 9
+    if err := kv.store(*args); err != nil {
+        return err
     }
-    kv.recentWrites[kv.writeIndex] = *args
+    kv.recordWrite(*args)
     *reply = true
     return nil
 }
 
-func (kv *KVNode) Update(args *KeyValue, reply *bool) error {
+// Coordinate a client write. args.Version is the version the client read
+// (nil for a blind write); the write gets a new version that descends from it
+// and from every write we coordinated before. The stored version is returned
+// so it can be sent to the other replicas.
+func (kv *KVNode) Put(args *KeyValue, reply *KeyValue) error {
+    kv.nodeMutex.Lock()
+    defer kv.nodeMutex.Unlock()
+    defer kv.Debug()
+    var err error
+    *reply, err = kv.put(*args)
+    return err
+}
+
+// Same as Put, but only for a key we already have
+func (kv *KVNode) Update(args *KeyValue, reply *KeyValue) error {
     kv.nodeMutex.Lock()
     defer kv.nodeMutex.Unlock()
     defer kv.Debug()
-    keyValue, ok := kv.KeyValues[args.Key]
-    if !ok {
-        *reply = false
+    if len(kv.Store.Get(args.Key).Live()) == 0 {
         return ErrNoKey
     }
-    if args.Time > keyValue.Time {
-        kv.KeyValues[args.Key] = *args
+    var err error
+    *reply, err = kv.put(*args)
+    return err
+}
+
+func (kv *KVNode) put(keyValue KeyValue) (KeyValue, error) {
+    siblings := kv.Store.Get(keyValue.Key)
+    counter := keyValue.Version[kv.Name]
+    for _, s := range siblings {
+        if s.Version[kv.Name] > counter {
+            counter = s.Version[kv.Name]
+        }
+    }
+    keyValue.Version = keyValue.Version.Copy()
+    keyValue.Version[kv.Name] = counter + 1
+    if err := kv.store(keyValue); err != nil {
+        return keyValue, err
     }
-    kv.writeIndex -= 1
-    if kv.writeIndex < 0 {
-        kv.writeIndex = 9
+    kv.recordWrite(keyValue)
+    return keyValue, nil
+}
+
+// Merge a version into what we have, writing only if it was news
+func (kv *KVNode) store(keyValue KeyValue) error {
+    if keyValue.Deleted {
+        keyValue.deletedAt = StampNow()
     }
-    kv.recentWrites[kv.writeIndex] = *args
-    *reply = true
-    return nil
+    siblings, changed := mergeSibling(kv.Store.Get(keyValue.Key), keyValue, kv.Policy)
+    if !changed {
+        return nil
+    }
+    atomic.AddInt64(&kv.changes, 1)
+    return kv.Store.Put(keyValue.Key, siblings)
 }
 
-func (kv *KVNode) Lookup(args *Key, reply *KeyValue) error {
+func (kv *KVNode) Lookup(args *Key, reply *Siblings) error {
     kv.nodeMutex.Lock()
     defer kv.nodeMutex.Unlock()
     defer kv.Debug()
-    v, ok := kv.KeyValues[*args]
-    if !ok {
-        *reply = KeyValue{ Key:Key(0), Time: Timestamp(0), Value: "does not exist"}
+    siblings := kv.Store.Get(*args)
+    if len(siblings) == 0 {
         return ErrNoKey
     }
-    kv.readIndex -= 1
-    if kv.readIndex < 0 {
-        kv.readIndex = 9
+    for _, v := range siblings {
+        kv.readIndex -= 1
+        if kv.readIndex < 0 {
+            kv.readIndex = 9
+        }
+        kv.recentReads[kv.readIndex] = v
     }
-    kv.recentReads[kv.readIndex] = v
-    *reply = v
+    *reply = append(Siblings(nil), siblings...)
     return nil
 }
 
-func (kv *KVNode) Delete(args *Key, reply *bool) error {
+// Coordinate a delete. The tombstone supersedes every version we have and
+// the version the client read, if any, and is returned so it can be sent to
+// the other replicas. Deleting a key we have never seen still leaves a
+// tombstone, since other replicas may have it.
+func (kv *KVNode) Delete(args *KeyValue, reply *KeyValue) error {
     kv.nodeMutex.Lock()
     defer kv.nodeMutex.Unlock()
     defer kv.Debug()
-    _, ok := kv.KeyValues[*args]
-    if !ok {
-        *reply = false
-        return ErrNoKey
+    tombstone := KeyValue{Key: args.Key, Time: args.Time, Version: args.Version, Deleted: true}
+    for _, s := range kv.Store.Get(args.Key) {
+        tombstone.Version = tombstone.Version.Merge(s.Version)
     }
-    delete(kv.KeyValues, *args)
+    var err error
+    *reply, err = kv.put(tombstone)
+    return err
+}
+
+// Hold a write for a replica that could not be reached, for a coordinator
+// that is not a node itself
+func (kv *KVNode) Hint(args *Hint, reply *bool) error {
+    hint := *args
+    hint.At = StampNow()
+    kv.Hints.Add(hint)
     *reply = true
     return nil
 }
 
+// Drop a key we are no longer a replica of, without leaving a tombstone
+func (kv *KVNode) Forget(k Key) error {
+    kv.nodeMutex.Lock()
+    defer kv.nodeMutex.Unlock()
+    atomic.AddInt64(&kv.changes, 1)
+    return kv.Store.Remove(k)
+}
+
+// Drop tombstones older than the grace period, and keys left with nothing
+// else. Returns how many tombstones were dropped.
+func (kv *KVNode) CollectTombstones() int {
+    kv.nodeMutex.Lock()
+    defer kv.nodeMutex.Unlock()
+    grace := kv.TombstoneGrace
+    if grace == 0 {
+        grace = DefaultTombstoneGrace
+    }
+    now := StampNow()
+    collected := 0
+    for _, k := range kv.Store.Keys() {
+        siblings := kv.Store.Get(k)
+        kept := siblings[:0:0]
+        for _, s := range siblings {
+            if s.Deleted && now - s.deletedAt > grace {
+                collected++
+                continue
+            }
+            kept = append(kept, s)
+        }
+        var err error
+        if len(kept) == 0 {
+            atomic.AddInt64(&kv.changes, 1)
+            err = kv.Store.Remove(k)
+        } else if len(kept) != len(siblings) {
+            atomic.AddInt64(&kv.changes, 1)
+            err = kv.Store.Put(k, kept)
+        }
+        if err != nil {
+            log.Println("could not collect tombstones:", err)
+        }
+    }
+    return collected
+}
+
+func (kv *KVNode) TombstoneProcess() {
+    for {
+        if n := kv.CollectTombstones(); n > 0 {
+            log.Println("collected", n, "tombstones")
+        }
+        time.Sleep(time.Minute)
+    }
+}
+
 func (kv *KVNode) StaleKeys(prevHash HashedKey) []KeyValue {
     staleKeys := make([]KeyValue, 0, 16)
-    for k, keyValue := range kv.KeyValues {
+    for _, k := range kv.Store.Keys() {
         hashedKey := k.Hashed()
         if !hashInRange(prevHash, kv.maxHashedKey, hashedKey) {
-            staleKeys = append(staleKeys, keyValue)
+            staleKeys = append(staleKeys, kv.Store.Get(k)...)
         }
     }
     return staleKeys
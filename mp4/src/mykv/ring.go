@@ -0,0 +1,207 @@
+package mykv
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "hash/fnv"
+    "math"
+    "sort"
+    "strconv"
+    "sync"
+
+    "membertable"
+)
+
+// How many tokens (virtual nodes) a member with weight 1 gets on the ring.
+// Every node has to use the same value, or they will place keys differently.
+var TokensPerWeight = 64
+
+// The most tokens a single member can get, however heavy it claims to be
+const MaxTokens = 1024
+
+// A member's place in the ring
+type RingMember struct {
+    ID membertable.ID
+    // replicas of a key are spread over as many racks as possible
+    Rack string
+    // how many vertices the member gets on the ring; its share of the keys
+    // grows with it
+    Tokens int
+}
+
+// The members of the ring at some version. Every node applying the same raft
+// log sees the same ring at the same version.
+type Ring struct {
+    Version int64
+    Members []RingMember
+}
+
+// Replaces the ring's members when committed
+type SetRingCommand struct {
+    Members []RingMember
+}
+
+func init() {
+    gob.Register(SetRingCommand{})
+}
+
+func sortedMembers(members []RingMember) []RingMember {
+    sorted := append([]RingMember(nil), members...)
+    sort.Slice(sorted, func(i, j int) bool {
+        a, b := sorted[i].ID, sorted[j].ID
+        if a.Num != b.Num {
+            return a.Num < b.Num
+        }
+        return a.Address < b.Address
+    })
+    return sorted
+}
+
+// The rack a member is in, going by its zone if it has no rack tag
+func rackOf(member membertable.Member) string {
+    if rack := member.Tag(membertable.TagRack); rack != "" {
+        return rack
+    }
+    return member.Tag(membertable.TagZone)
+}
+
+// The number of tokens for a member, going by its weight tag. Members without
+// a usable weight count as weight 1.
+func tokensOf(member membertable.Member) int {
+    weight, err := strconv.ParseFloat(member.Tag(membertable.TagWeight), 64)
+    if err != nil || !(weight > 0) || math.IsInf(weight, 0) {
+        weight = 1
+    }
+    tokens := int(math.Min(math.Floor(weight * float64(TokensPerWeight) + 0.5), MaxTokens))
+    if tokens < 1 {
+        tokens = 1
+    }
+    return tokens
+}
+
+// Where a member's i-th token sits on the ring. Only depends on the ID, so
+// every node puts the same member in the same places. FNV barely mixes the
+// last bytes it sees, and those are all that differ between tokens, so the
+// sum goes through murmur3's finalizer to spread them around the ring.
+func tokenHash(id membertable.ID, i int) HashedKey {
+    hasher := fnv.New32a()
+    binary.Write(hasher, binary.BigEndian, id.Hashed())
+    binary.Write(hasher, binary.BigEndian, uint32(i))
+    h := hasher.Sum32()
+    h ^= h >> 16
+    h *= 0x85ebca6b
+    h ^= h >> 13
+    h *= 0xc2b2ae35
+    h ^= h >> 16
+    return HashedKey(h)
+}
+
+// The ring made of the given members, in the order a ring keeps them
+func RingMembers(members []membertable.Member) []RingMember {
+    ring := make([]RingMember, 0, len(members))
+    for _, member := range members {
+        ring = append(ring, RingMember{member.ID, rackOf(member), tokensOf(member)})
+    }
+    return sortedMembers(ring)
+}
+
+func ringIDs(members []RingMember) []membertable.ID {
+    ids := make([]membertable.ID, 0, len(members))
+    for _, member := range members {
+        ids = append(ids, member.ID)
+    }
+    return ids
+}
+
+// Whether the ring is made of exactly the given members
+func (r Ring) Same(members []RingMember) bool {
+    if len(r.Members) != len(members) {
+        return false
+    }
+    members = sortedMembers(members)
+    for i := range members {
+        if r.Members[i] != members[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// The members in a and not in b
+func idsMissing(a, b []membertable.ID) []membertable.ID {
+    in := make(map[membertable.ID]bool)
+    for _, id := range b {
+        in[id] = true
+    }
+    var missing []membertable.ID
+    for _, id := range a {
+        if !in[id] {
+            missing = append(missing, id)
+        }
+    }
+    return missing
+}
+
+// The ring as a raft state machine
+type RingLog struct {
+    // Called with the new ring and who joined and left it whenever a change
+    // is applied. It runs inside raft and must not propose anything.
+    Changed func(ring Ring, joined, left []membertable.ID)
+
+    ring Ring
+    mutex sync.Mutex
+}
+
+func (l *RingLog) Apply(index int64, command interface{}) interface{} {
+    set := command.(SetRingCommand)
+
+    l.mutex.Lock()
+    old := l.ring
+    l.ring = Ring{old.Version + 1, sortedMembers(set.Members)}
+    ring := l.ring
+    l.mutex.Unlock()
+
+    if l.Changed != nil {
+        l.Changed(ring, idsMissing(ringIDs(ring.Members), ringIDs(old.Members)),
+                  idsMissing(ringIDs(old.Members), ringIDs(ring.Members)))
+    }
+    return ring.Version
+}
+
+func (l *RingLog) Snapshot() ([]byte, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(l.ring)
+    return buf.Bytes(), err
+}
+
+func (l *RingLog) Restore(snapshot []byte) error {
+    var ring Ring
+    if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&ring); err != nil {
+        return err
+    }
+
+    l.mutex.Lock()
+    old := l.ring
+    l.ring = ring
+    l.mutex.Unlock()
+
+    if l.Changed != nil {
+        l.Changed(ring, idsMissing(ringIDs(ring.Members), ringIDs(old.Members)),
+                  idsMissing(ringIDs(old.Members), ringIDs(ring.Members)))
+    }
+    return nil
+}
+
+func (l *RingLog) Current() Ring {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return l.ring
+}
+
+func (l *RingLog) RPCGetRing(dummy int, ring *Ring) error {
+    *ring = l.Current()
+    return nil
+}
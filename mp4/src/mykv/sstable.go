@@ -0,0 +1,306 @@
+package mykv
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "hash/fnv"
+    "io"
+    "os"
+    "sort"
+)
+
+// Records are grouped into blocks of about this many bytes; a lookup reads
+// one block
+const blockSize = 4096
+
+// Bloom filter bits per key and hash functions, for about a 1% false
+// positive rate
+const bloomBitsPerKey = 10
+const bloomHashes = 7
+
+const sstableMagic = uint32(0x6d796b76)
+
+var (
+    ErrBadTable = errors.New("corrupt sstable")
+)
+
+// A sorted, immutable file of records.
+//
+// Layout (big endian): data blocks of records, each written like a log
+// record; then the index, which for each block is its first key (uint32),
+// offset (uint64) and length (uint32); then the bloom filter bits; then the
+// footer: index offset (uint64), block count (uint32), bloom offset
+// (uint64), bloom length (uint32), key count (uint32) and a magic number.
+type sstable struct {
+    filename string
+    file *os.File
+    index []blockHandle
+    bloom []byte
+    keys int
+    // scans reading the table without the store's lock; a table a compaction
+    // replaced is deleted once the last of them is done
+    refs int
+    obsolete bool
+}
+
+type blockHandle struct {
+    FirstKey Key
+    Offset uint64
+    Length uint32
+}
+
+type sstableFooter struct {
+    IndexOffset uint64
+    Blocks uint32
+    BloomOffset uint64
+    BloomLength uint32
+    Keys uint32
+    Magic uint32
+}
+
+// Two independent hashes of a key, combined for each of the bloom hashes
+func bloomHashPair(k Key) (uint32, uint32) {
+    var buf [4]byte
+    binary.BigEndian.PutUint32(buf[:], uint32(k))
+    h1 := fnv.New32a()
+    h1.Write(buf[:])
+    h2 := fnv.New32()
+    h2.Write(buf[:])
+    return h1.Sum32(), h2.Sum32() | 1
+}
+
+func bloomAdd(bloom []byte, k Key) {
+    h1, h2 := bloomHashPair(k)
+    bits := uint32(len(bloom) * 8)
+    for i := uint32(0); i < bloomHashes; i++ {
+        bit := (h1 + i * h2) % bits
+        bloom[bit / 8] |= 1 << (bit % 8)
+    }
+}
+
+func bloomHas(bloom []byte, k Key) bool {
+    if len(bloom) == 0 {
+        return true
+    }
+    h1, h2 := bloomHashPair(k)
+    bits := uint32(len(bloom) * 8)
+    for i := uint32(0); i < bloomHashes; i++ {
+        bit := (h1 + i * h2) % bits
+        if bloom[bit / 8] & (1 << (bit % 8)) == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// Write the records, which must be sorted by key, to a new table at
+// filename. The file is synced before this returns.
+func writeSSTable(filename string, records []walRecord) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    var offset uint64
+    var index []blockHandle
+    var block bytes.Buffer
+    bloom := make([]byte, (len(records) * bloomBitsPerKey + 7) / 8 + 1)
+
+    flushBlock := func() error {
+        if block.Len() == 0 {
+            return nil
+        }
+        index[len(index) - 1].Length = uint32(block.Len())
+        n, err := w.Write(block.Bytes())
+        offset += uint64(n)
+        block.Reset()
+        return err
+    }
+
+    for _, record := range records {
+        if block.Len() == 0 {
+            index = append(index, blockHandle{FirstKey: record.Key, Offset: offset})
+        }
+        if err = writeRecord(&block, record); err != nil {
+            break
+        }
+        bloomAdd(bloom, record.Key)
+        if block.Len() >= blockSize {
+            if err = flushBlock(); err != nil {
+                break
+            }
+        }
+    }
+    if err == nil {
+        err = flushBlock()
+    }
+
+    footer := sstableFooter{IndexOffset: offset, Blocks: uint32(len(index)), Keys: uint32(len(records)), Magic: sstableMagic}
+    if err == nil {
+        err = binary.Write(w, binary.BigEndian, index)
+    }
+    footer.BloomOffset = offset + uint64(len(index)) * 16
+    footer.BloomLength = uint32(len(bloom))
+    if err == nil {
+        _, err = w.Write(bloom)
+    }
+    if err == nil {
+        err = binary.Write(w, binary.BigEndian, footer)
+    }
+    if err == nil {
+        err = w.Flush()
+    }
+    if err == nil {
+        err = f.Sync()
+    }
+    f.Close()
+    if err != nil {
+        os.Remove(filename)
+    }
+    return err
+}
+
+// Open a table and read its index and bloom filter into memory
+func openSSTable(filename string) (*sstable, error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    t := &sstable{filename: filename, file: f}
+    if err = t.load(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return t, nil
+}
+
+func (t *sstable) load() error {
+    info, err := t.file.Stat()
+    if err != nil {
+        return err
+    }
+    var footer sstableFooter
+    footerSize := int64(binary.Size(footer))
+    if info.Size() < footerSize {
+        return ErrBadTable
+    }
+    r := io.NewSectionReader(t.file, info.Size() - footerSize, footerSize)
+    if err = binary.Read(r, binary.BigEndian, &footer); err != nil {
+        return err
+    }
+    if footer.Magic != sstableMagic {
+        return ErrBadTable
+    }
+
+    t.index = make([]blockHandle, footer.Blocks)
+    r = io.NewSectionReader(t.file, int64(footer.IndexOffset), int64(footer.Blocks) * 16)
+    if err = binary.Read(r, binary.BigEndian, t.index); err != nil {
+        return ErrBadTable
+    }
+    t.bloom = make([]byte, footer.BloomLength)
+    if _, err = t.file.ReadAt(t.bloom, int64(footer.BloomOffset)); err != nil {
+        return ErrBadTable
+    }
+    t.keys = int(footer.Keys)
+    return nil
+}
+
+func (t *sstable) readBlock(i int) ([]walRecord, error) {
+    handle := t.index[i]
+    data := make([]byte, handle.Length)
+    if _, err := t.file.ReadAt(data, int64(handle.Offset)); err != nil {
+        return nil, err
+    }
+    var records []walRecord
+    r := bytes.NewReader(data)
+    for r.Len() > 0 {
+        record, _, err := readRecord(r)
+        if err != nil {
+            return nil, ErrBadTable
+        }
+        records = append(records, record)
+    }
+    return records, nil
+}
+
+// The record for k, if the table has one
+func (t *sstable) get(k Key) (walRecord, bool, error) {
+    if !bloomHas(t.bloom, k) {
+        return walRecord{}, false, nil
+    }
+    // the last block starting at or before k
+    i := sort.Search(len(t.index), func(i int) bool {
+        return t.index[i].FirstKey > k
+    }) - 1
+    if i < 0 {
+        return walRecord{}, false, nil
+    }
+    records, err := t.readBlock(i)
+    if err != nil {
+        return walRecord{}, false, err
+    }
+    for _, record := range records {
+        if record.Key == k {
+            return record, true, nil
+        }
+    }
+    return walRecord{}, false, nil
+}
+
+func (t *sstable) close() error {
+    return t.file.Close()
+}
+
+// Delete the table if it is obsolete and nothing is reading it
+func (t *sstable) release() {
+    if t.obsolete && t.refs == 0 {
+        t.close()
+        os.Remove(t.filename)
+    }
+}
+
+// Walks the records of a table in key order, one block at a time
+type tableIterator struct {
+    table *sstable
+    block int
+    records []walRecord
+    err error
+}
+
+// Start at the first record with a key of at least start
+func (t *sstable) iterator(start Key) *tableIterator {
+    it := &tableIterator{table: t}
+    it.block = sort.Search(len(t.index), func(i int) bool {
+        return t.index[i].FirstKey > start
+    }) - 1
+    if it.block < 0 {
+        it.block = 0
+    }
+    it.load()
+    for it.valid() && it.record().Key < start {
+        it.next()
+    }
+    return it
+}
+
+func (it *tableIterator) load() {
+    for it.err == nil && len(it.records) == 0 && it.block < len(it.table.index) {
+        it.records, it.err = it.table.readBlock(it.block)
+        it.block++
+    }
+}
+
+func (it *tableIterator) valid() bool {
+    return it.err == nil && len(it.records) > 0
+}
+
+func (it *tableIterator) record() walRecord {
+    return it.records[0]
+}
+
+func (it *tableIterator) next() {
+    it.records = it.records[1:]
+    it.load()
+}
@@ -0,0 +1,70 @@
+package mykv
+
+import (
+    "sync"
+)
+
+// Where a KVNode keeps its keys. Implementations are safe to call from
+// several goroutines.
+type Store interface {
+    // The siblings stored for k, or none
+    Get(k Key) Siblings
+    // Replace the siblings stored for k
+    Put(k Key, siblings Siblings) error
+    // Forget k entirely
+    Remove(k Key) error
+    // Every stored key, in no particular order
+    Keys() []Key
+    Len() int
+    Close() error
+}
+
+// Keeps everything in a map; lost when the process exits
+type MemoryStore struct {
+    keys map[Key]Siblings
+    mutex sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{keys: make(map[Key]Siblings)}
+}
+
+func (m *MemoryStore) Get(k Key) Siblings {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    return m.keys[k]
+}
+
+func (m *MemoryStore) Put(k Key, siblings Siblings) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    m.keys[k] = siblings
+    return nil
+}
+
+func (m *MemoryStore) Remove(k Key) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    delete(m.keys, k)
+    return nil
+}
+
+func (m *MemoryStore) Keys() []Key {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    keys := make([]Key, 0, len(m.keys))
+    for k := range m.keys {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+func (m *MemoryStore) Len() int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    return len(m.keys)
+}
+
+func (m *MemoryStore) Close() error {
+    return nil
+}
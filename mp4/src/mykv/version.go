@@ -0,0 +1,132 @@
+package mykv
+
+// A version vector: how many writes each node has coordinated for a key
+type VersionVector map[string]uint64
+
+// How two versions relate
+type Ordering int
+
+const (
+    Equal Ordering = iota
+    Before
+    After
+    Concurrent
+)
+
+// How a replica settles two versions of a key that neither descends from
+type ConflictPolicy int
+
+const (
+    // keep both as siblings until a client writes back a resolution
+    KeepSiblings ConflictPolicy = iota
+    // keep whichever was written at the later client time
+    LastWriteWins
+)
+
+func (v VersionVector) Copy() VersionVector {
+    c := make(VersionVector, len(v))
+    for node, n := range v {
+        c[node] = n
+    }
+    return c
+}
+
+// Whether v happened before, after or concurrently with other
+func (v VersionVector) Compare(other VersionVector) Ordering {
+    less, greater := false, false
+    for node, n := range v {
+        if n > other[node] {
+            greater = true
+        } else if n < other[node] {
+            less = true
+        }
+    }
+    for node, n := range other {
+        if _, ok := v[node]; !ok && n > 0 {
+            less = true
+        }
+    }
+    switch {
+        case less && greater: return Concurrent
+        case less: return Before
+        case greater: return After
+    }
+    return Equal
+}
+
+// The smallest version that descends from both v and other
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+    merged := v.Copy()
+    for node, n := range other {
+        if n > merged[node] {
+            merged[node] = n
+        }
+    }
+    return merged
+}
+
+// The versions of a key that no other version descends from. A key written
+// concurrently has more than one.
+type Siblings []KeyValue
+
+// The version to write back with so the write supersedes every sibling
+func (s Siblings) Context() VersionVector {
+    context := VersionVector{}
+    for _, kv := range s {
+        context = context.Merge(kv.Version)
+    }
+    return context
+}
+
+// The sibling written at the latest client time, or nil if there are none
+func (s Siblings) Newest() *KeyValue {
+    var newest *KeyValue
+    for i := range s {
+        if newest == nil || s[i].Time > newest.Time {
+            newest = &s[i]
+        }
+    }
+    return newest
+}
+
+// The siblings that are not tombstones
+func (s Siblings) Live() Siblings {
+    live := make(Siblings, 0, len(s))
+    for _, kv := range s {
+        if !kv.Deleted {
+            live = append(live, kv)
+        }
+    }
+    return live
+}
+
+// Add kv to the siblings, dropping any it supersedes. Returns the new
+// siblings and whether kv was news to them.
+func mergeSibling(siblings Siblings, kv KeyValue, policy ConflictPolicy) (Siblings, bool) {
+    if policy == LastWriteWins {
+        if newest := siblings.Newest(); newest != nil && kv.Time <= newest.Time {
+            return siblings, false
+        }
+        return Siblings{kv}, true
+    }
+
+    merged := make(Siblings, 0, len(siblings) + 1)
+    for _, s := range siblings {
+        switch kv.Version.Compare(s.Version) {
+            case Equal, Before:
+                // we already have it or something newer
+                return siblings, false
+            case Concurrent:
+                merged = append(merged, s)
+        }
+    }
+    return append(merged, kv), true
+}
+
+// Merge every version in b into a
+func mergeSiblings(a, b Siblings, policy ConflictPolicy) Siblings {
+    for _, kv := range b {
+        a, _ = mergeSibling(a, kv, policy)
+    }
+    return a
+}
@@ -0,0 +1,80 @@
+package mykv
+
+import (
+    "testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+    a := VersionVector{"a": 2, "b": 1}
+    cases := []struct {
+        other VersionVector
+        want Ordering
+    }{
+        {VersionVector{"a": 2, "b": 1}, Equal},
+        {VersionVector{"a": 2, "b": 1, "c": 0}, Equal},
+        {VersionVector{"a": 3, "b": 1}, Before},
+        {VersionVector{"a": 2, "b": 1, "c": 1}, Before},
+        {VersionVector{"a": 1}, After},
+        {nil, After},
+        {VersionVector{"a": 1, "b": 2}, Concurrent},
+        {VersionVector{"c": 1}, Concurrent},
+    }
+    for _, c := range cases {
+        if got := a.Compare(c.other); got != c.want {
+            t.Errorf("%v against %v is %v, want %v", a, c.other, got, c.want)
+        }
+    }
+}
+
+func TestConcurrentPutsBecomeSiblings(t *testing.T) {
+    a, b := NewNode(0), NewNode(0)
+    a.Name, b.Name = "a", "b"
+
+    var fromA, fromB KeyValue
+    a.Put(&KeyValue{Key: 1, Value: "from a"}, &fromA)
+    b.Put(&KeyValue{Key: 1, Value: "from b"}, &fromB)
+
+    // Neither write saw the other, so both survive replication
+    var ok bool
+    a.Insert(&fromB, &ok)
+    b.Insert(&fromA, &ok)
+    var siblings Siblings
+    b.Lookup(&fromA.Key, &siblings)
+    if len(siblings) != 2 {
+        t.Fatal("concurrent writes left", siblings)
+    }
+
+    // Writing back with their context resolves them
+    var resolved KeyValue
+    b.Put(&KeyValue{Key: 1, Version: siblings.Context(), Value: "both"}, &resolved)
+    a.Insert(&resolved, &ok)
+    for _, node := range []*KVNode{a, b} {
+        node.Lookup(&resolved.Key, &siblings)
+        if len(siblings) != 1 || siblings[0].Value != "both" {
+            t.Error(node.Name, "still has", siblings)
+        }
+    }
+
+    // Old versions arriving late change nothing
+    a.Insert(&fromA, &ok)
+    a.Lookup(&resolved.Key, &siblings)
+    if len(siblings) != 1 || siblings[0].Value != "both" {
+        t.Error("an old version came back:", siblings)
+    }
+}
+
+func TestLastWriteWins(t *testing.T) {
+    node := NewNode(0)
+    node.Policy = LastWriteWins
+
+    var stored KeyValue
+    var ok bool
+    node.Put(&KeyValue{Key: 1, Time: 20, Value: "newer"}, &stored)
+    node.Insert(&KeyValue{Key: 1, Time: 10, Version: VersionVector{"other": 1}, Value: "older"}, &ok)
+
+    var siblings Siblings
+    node.Lookup(&stored.Key, &siblings)
+    if len(siblings) != 1 || siblings[0].Value != "newer" {
+        t.Error("last write did not win:", siblings)
+    }
+}